@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// boxCacheVersion is bumped whenever BoxCacheEntry gains information, so that
+// entries written by older versions are worked out again.
+const boxCacheVersion = 1
+
+// BoxCache remembers what has been worked out about each box file (its
+// checksum and the metadata inside the archive), keyed by path, size and
+// modification time, so that restarting over a large library does not mean
+// reading every box again. Files that are not in the cache are processed one
+// at a time by a background worker.
+type BoxCache struct {
+	Location string
+	OnUpdate func()
+	entries  map[string]BoxCacheEntry
+	pending  []cacheJob
+	queued   map[string]bool
+	wake     chan struct{}
+	mutex    sync.Mutex
+}
+
+type cacheJob struct {
+	storage  Storage
+	object   StorageObject
+	provider string
+}
+
+type BoxCacheEntry struct {
+	CacheVersion int                    `json:"cache_version"`
+	Size         int64                  `json:"size"`
+	ModTime      int64                  `json:"mtime"`
+	Sha256       string                 `json:"sha256"`
+	Metadata     *BoxMetadata           `json:"metadata,omitempty"`
+	Info         map[string]interface{} `json:"info,omitempty"`
+}
+
+// Load reads the cache from disk and starts the background worker.
+func (bc *BoxCache) Load() {
+	bc.mutex.Lock()
+	bc.entries = make(map[string]BoxCacheEntry)
+	bc.queued = make(map[string]bool)
+	bc.wake = make(chan struct{}, 1)
+	if data, err := ioutil.ReadFile(bc.Location); err == nil {
+		if err := json.Unmarshal(data, &bc.entries); err != nil {
+			logger.Warn("Ignoring unreadable box cache", "file", bc.Location, "error", err)
+			bc.entries = make(map[string]BoxCacheEntry)
+		}
+	}
+	bc.mutex.Unlock()
+	go bc.work()
+}
+
+// Lookup returns the cached entry for a box if it has not changed since it
+// was processed.
+func (bc *BoxCache) Lookup(location string, size int64, modTime time.Time) (BoxCacheEntry, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	entry, ok := bc.entries[location]
+	if !ok || entry.CacheVersion != boxCacheVersion || entry.Size != size || entry.ModTime != modTime.UnixNano() {
+		return BoxCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Queue asks the background worker to process a box. The provider is the one
+// named in its filename, which the metadata inside the box is checked against.
+func (bc *BoxCache) Queue(s Storage, object StorageObject, provider string) {
+	location := s.Location(object.Key)
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.queued[location] {
+		return
+	}
+	bc.queued[location] = true
+	bc.pending = append(bc.pending, cacheJob{storage: s, object: object, provider: provider})
+	select {
+	case bc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (bc *BoxCache) work() {
+	for range bc.wake {
+		for {
+			bc.mutex.Lock()
+			if len(bc.pending) == 0 {
+				bc.mutex.Unlock()
+				break
+			}
+			job := bc.pending[0]
+			bc.pending = bc.pending[1:]
+			bc.mutex.Unlock()
+
+			location := job.storage.Location(job.object.Key)
+			entry, err := processBoxFile(job.storage, job.object)
+
+			bc.mutex.Lock()
+			delete(bc.queued, location)
+			if err == nil {
+				bc.entries[location] = entry
+			}
+			bc.mutex.Unlock()
+
+			if err != nil {
+				logger.Warn("Could not process box", "file", location, "error", err)
+				continue
+			}
+			logger.Info("Checksummed box", "file", location, "sha256", entry.Sha256)
+			if entry.Metadata != nil && (Provider{Name: job.provider, ArchiveProvider: entry.Metadata.Provider}).ProviderMismatch() {
+				logger.Warn("Provider mismatch", "file", location, "filename", job.provider, "metadata", entry.Metadata.Provider)
+			}
+			if bc.OnUpdate != nil {
+				bc.OnUpdate()
+			}
+		}
+		bc.save()
+	}
+}
+
+func (bc *BoxCache) save() {
+	bc.mutex.Lock()
+	data, err := json.MarshalIndent(bc.entries, "", "  ")
+	bc.mutex.Unlock()
+	if err == nil {
+		err = ioutil.WriteFile(bc.Location+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(bc.Location+".tmp", bc.Location)
+	}
+	if err != nil {
+		logger.Error("Could not save box cache", "file", bc.Location, "error", err)
+	}
+}
+
+// processBoxFile checksums a box and extracts metadata.json and info.json
+// from it. Tar and gzipped tar boxes are read in a single pass.
+func processBoxFile(s Storage, object StorageObject) (BoxCacheEntry, error) {
+	location := s.Location(object.Key)
+	f := newStorageReader(s, object.Key, object.Size)
+	defer f.Close()
+	entry := BoxCacheEntry{CacheVersion: boxCacheVersion, Size: object.Size, ModTime: object.ModTime.UnixNano()}
+
+	hash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(f, hash))
+	magic, _ := reader.Peek(4)
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) {
+		// Zip needs random access, so it is read separately from hashing.
+		if err := readZipMetadata(f, object.Size, &entry); err != nil {
+			logger.Warn("Could not read box metadata", "file", location, "error", err)
+		}
+	} else if err := readTarMetadata(reader, bytes.HasPrefix(magic, []byte{0x1f, 0x8b}), &entry); err != nil {
+		logger.Warn("Could not read box metadata", "file", location, "error", err)
+	}
+
+	// Hash whatever the archive readers did not need to look at.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return BoxCacheEntry{}, err
+	}
+	entry.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return entry, nil
+}
+
+// isMetadataFile reports whether an archive member is metadata.json or
+// info.json at the root of the box, returning which one.
+func isMetadataFile(name string) (string, bool) {
+	name = path.Clean("/" + name)
+	if name == "/metadata.json" || name == "/info.json" {
+		return name[1:], true
+	}
+	return "", false
+}
+
+func storeMetadataFile(name string, r io.Reader, entry *BoxCacheEntry) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return err
+	}
+	if name == "metadata.json" {
+		metadata := BoxMetadata{}
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return err
+		}
+		entry.Metadata = &metadata
+	} else {
+		if err := json.Unmarshal(data, &entry.Info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTarMetadata(r io.Reader, gzipped bool, entry *BoxCacheEntry) error {
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if name, ok := isMetadataFile(header.Name); ok {
+			if err := storeMetadataFile(name, tr, entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readZipMetadata(f io.ReaderAt, size int64, entry *BoxCacheEntry) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range zr.File {
+		if name, ok := isMetadataFile(file.Name); ok {
+			rc, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = storeMetadataFile(name, rc, entry)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
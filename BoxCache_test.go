@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func waitForCache(t *testing.T, updated chan bool) {
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the box cache")
+	}
+}
+
+func TestCacheChecksumsBoxesInBackground(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-cache")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")
+	ioutil.WriteFile(location, []byte("box contents"), 0644)
+
+	updated := make(chan bool, 1)
+	bh := BoxHandler{}
+	cache := BoxCache{Location: filepath.Join(dir, "cache.json"), OnUpdate: func() { updated <- true }}
+	cache.Load()
+	bh.Cache = &cache
+
+	host := "localhost"
+	port := 80
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	assert.True(bh.GetBox("benphegan", "dev").Pending())
+	assert.Equal("", bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0].Checksum)
+
+	waitForCache(t, updated)
+	bh.applyBoxCache()
+	provider := bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0]
+	assert.False(bh.GetBox("benphegan", "dev").Pending())
+	assert.Equal("sha256", provider.ChecksumType)
+	assert.Equal("05e41e9351bb04ca0082cc2c61870d8a433768ea01b53bbcb7d987ecd538b310", provider.Checksum)
+}
+
+func TestCacheIsInvalidatedWhenBoxChanges(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-cache")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")
+	ioutil.WriteFile(location, []byte("box contents"), 0644)
+
+	updated := make(chan bool, 1)
+	cache := BoxCache{Location: filepath.Join(dir, "cache.json"), OnUpdate: func() { updated <- true }}
+	cache.Load()
+	storage := &FileStorage{Root: dir}
+	object, _ := storage.Stat("benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")
+	cache.Queue(storage, object, "virtualbox")
+	waitForCache(t, updated)
+	_, ok := cache.Lookup(location, object.Size, object.ModTime)
+	assert.True(ok)
+
+	ioutil.WriteFile(location, []byte("different box contents"), 0644)
+	object, _ = storage.Stat("benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")
+	_, ok = cache.Lookup(location, object.Size, object.ModTime)
+	assert.False(ok)
+}
+
+func writeTestBox(t *testing.T, location string, gzipped bool, files map[string]string) {
+	f, err := os.Create(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if gzipped {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for name, contents := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})
+		tw.Write([]byte(contents))
+	}
+}
+
+func TestCanReadMetadataFromGzippedBox(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-cache")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")
+	writeTestBox(t, location, true, map[string]string{
+		"./metadata.json": `{"provider": "libvirt", "format": "qcow2", "architecture": "arm64"}`,
+		"info.json":       `{"author": "benphegan"}`,
+		"box.img":         "disk",
+	})
+
+	storage := &FileStorage{Root: dir}
+	object, _ := storage.Stat(filepath.Base(location))
+	entry, err := processBoxFile(storage, object)
+	assert.Nil(err)
+	assert.Equal("libvirt", entry.Metadata.Provider)
+	assert.Equal("qcow2", entry.Metadata.Format)
+	assert.Equal("arm64", entry.Metadata.Architecture)
+	assert.Equal("benphegan", entry.Info["author"])
+
+	contents, _ := ioutil.ReadFile(location)
+	sum := sha256.Sum256(contents)
+	assert.Equal(hex.EncodeToString(sum[:]), entry.Sha256)
+}
+
+func TestCanReadMetadataFromZipBox(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-cache")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__hyperv.box")
+	f, _ := os.Create(location)
+	zw := zip.NewWriter(f)
+	mw, _ := zw.Create("metadata.json")
+	mw.Write([]byte(`{"provider": "hyperv"}`))
+	zw.Close()
+	f.Close()
+
+	storage := &FileStorage{Root: dir}
+	object, _ := storage.Stat(filepath.Base(location))
+	entry, err := processBoxFile(storage, object)
+	assert.Nil(err)
+	assert.Equal("hyperv", entry.Metadata.Provider)
+}
+
+func TestFlagsProviderMismatch(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-cache")
+	defer os.RemoveAll(dir)
+	writeTestBox(t, filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), false, map[string]string{
+		"metadata.json": `{"provider": "vmware_desktop", "architecture": "amd64"}`,
+	})
+
+	updated := make(chan bool, 1)
+	bh := BoxHandler{}
+	cache := BoxCache{Location: filepath.Join(dir, "cache.json"), OnUpdate: func() { updated <- true }}
+	cache.Load()
+	bh.Cache = &cache
+	host := "localhost"
+	port := 80
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	waitForCache(t, updated)
+	bh.applyBoxCache()
+
+	provider := bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0]
+	assert.True(provider.ProviderMismatch())
+	assert.Equal("amd64", provider.Architecture)
+}
@@ -1,34 +1,119 @@
 package main
 
 import (
+	"fmt"
 	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/mcuadros/go-version"
-	"log"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type BoxHandler struct {
-	Boxes          map[string]map[string]Box
-	Directories    []string
 	TemplateString string
 	Hostname       string
 	Port           int
+	// Scheme is the scheme of generated URLs, http unless set.
+	Scheme string
+	// ExternalUrl, when set, is the address clients reach the server on,
+	// such as https://example.com/vagrant, and replaces Scheme, Hostname and
+	// Port in generated URLs. Its path is the prefix routes are served under.
+	ExternalUrl string
+	// TrustedProxies are the proxies whose X-Forwarded-* and Forwarded
+	// headers are believed.
+	TrustedProxies []*net.IPNet
+	// AllowedHosts are the hostnames, or patterns such as *.example.com,
+	// that URLs may be built for from a request's Host.
+	AllowedHosts []string
+	// RejectUnknownHosts rejects requests for other hosts, rather than
+	// answering them with URLs for Hostname.
+	RejectUnknownHosts bool
+	// RequestHost builds the URLs of each response from the address the
+	// request was made to, rather than from BaseUrl.
+	RequestHost bool
+	Publisher   *Publisher
+	Cache       *BoxCache
+	// TreeDirectories are the directories, also listed in Directories, whose
+	// boxes are laid out as <user>/<box>/<version>/<provider>.box.
+	TreeDirectories []string
+	// FilenamePattern overrides DefaultBoxRegex when set. It must have owner,
+	// boxname, version and provider groups, and may have an architecture group.
+	FilenamePattern string
+	// S3 holds the connection settings for s3://bucket/prefix directories.
+	S3 S3Config
+	// Tokens are the access tokens that can see private boxes.
+	Tokens *TokenStore
+	// OpenPublish leaves the publishing API open to anyone while there are
+	// no tokens. Otherwise publishing is refused until a token is added.
+	OpenPublish bool
+	// PrivateBoxes are user/box patterns, such as "benphegan/*", for boxes
+	// that need a token to be seen or downloaded.
+	PrivateBoxes []string
+	// Stats fills in the download count of each version.
+	Stats *DownloadStats
+	// Upstream, when set, answers for boxes that are not found locally.
+	Upstream *Upstream
+	// catalog holds the current *Catalog. indexMutex serialises building
+	// new ones, and guards the index state the catalog is built from.
+	catalog     atomic.Value
+	indexMutex  sync.Mutex
+	sources     []indexSource
+	files       map[string]SimpleBox
+	descriptors map[string]BoxDescriptor
+	port        int
+	hostname    string
+}
+
+// Catalog is a snapshot of every indexed box. A published snapshot is never
+// changed: reindexing builds a new one and swaps it in, so requests can read
+// a snapshot without locking while indexing carries on.
+type Catalog struct {
+	Boxes       map[string]map[string]Box
+	Directories []string
 }
 
+// boxNameSegment matches a single owner, box, provider or architecture name
+// as Vagrant allows them. Double underscores are kept free as separators.
+const boxNameSegment = `[a-zA-Z0-9](?:[a-zA-Z0-9.-]|_[a-zA-Z0-9.-])*`
+const boxVersionSegment = `[a-zA-Z0-9][a-zA-Z0-9.+-]*`
+
+// DefaultBoxRegex is the filename pattern used unless one is configured.
+const DefaultBoxRegex = `^(?P<owner>` + boxNameSegment + `)-VAGRANTSLASH-(?P<boxname>` + boxNameSegment + `)__(?P<version>` + boxVersionSegment + `)__(?P<provider>` + boxNameSegment + `)(?:__(?P<architecture>` + boxNameSegment + `))?\.box$`
+
+// Version states. Unreleased versions are only listed for callers with a
+// token for the box, and revoked versions are not listed at all.
+const (
+	VersionUnreleased = "unreleased"
+	VersionActive     = "active"
+	VersionRevoked    = "revoked"
+)
+
+var validBoxName = regexp.MustCompile(`^` + boxNameSegment + `$`)
+var validBoxVersion = regexp.MustCompile(`^` + boxVersionSegment + `$`)
+
+// BoxMetadata is the metadata.json found inside a box archive.
 type BoxMetadata struct {
-	Provider string `json:"provider"`
+	Provider     string `json:"provider"`
+	Architecture string `json:"architecture,omitempty"`
+	Format       string `json:"format,omitempty"`
 }
 
 type SimpleBox struct {
-	Username string
-	Boxname  string
-	Location string
-	Provider string
-	Version  string
+	Username     string
+	Boxname      string
+	Location     string
+	Provider     string
+	Version      string
+	Architecture string
+	Storage      Storage
+	Object       StorageObject
 }
 
 type Box struct {
@@ -41,8 +126,13 @@ type Box struct {
 	DescriptionMarkdown string    `json:"description_markdown"`
 	Username            string    `json:"username"`
 	Private             bool      `json:"private"`
+	Downloads           int       `json:"downloads"`
+	Tags                []string  `json:"tags,omitempty"`
 	CurrentVersion      *Version  `json:"current_version"`
 	Versions            []Version `json:"versions"`
+
+	// Retention is the box's own retention policy from its descriptor.
+	Retention *RetentionDescriptor `json:"-"`
 }
 
 type Version struct {
@@ -69,95 +159,528 @@ type Provider struct {
 	Updated      string `json:"updated_at"`
 	DownloadUrl  string `json:"download_url"`
 	Url          string `json:"url"`
-	LocalBoxFile string `json:"-"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksum_type,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	// DefaultArchitecture marks the architecture Vagrant uses when a
+	// version has several for the provider and none suits the host.
+	DefaultArchitecture bool   `json:"default_architecture"`
+	Format              string `json:"format,omitempty"`
+	// Info is the optional info.json shipped inside the box.
+	Info            map[string]interface{} `json:"info,omitempty"`
+	LocalBoxFile    string                 `json:"-"`
+	Storage         Storage                `json:"-"`
+	Object          StorageObject          `json:"-"`
+	Pending         bool                   `json:"-"`
+	ArchiveProvider string                 `json:"-"`
+}
+
+// ProviderMismatch reports whether the metadata.json inside the box names a
+// different provider to the one in its filename.
+func (p Provider) ProviderMismatch() bool {
+	return p.ArchiveProvider != "" && p.ArchiveProvider != p.Name
+}
+
+// Pending reports whether any provider of the box is still waiting for its
+// checksum to be calculated.
+func (b Box) Pending() bool {
+	for _, v := range b.Versions {
+		for _, p := range v.Providers {
+			if p.Pending {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ActiveVersions returns the released versions of the box.
+func (b Box) ActiveVersions() []Version {
+	versions := []Version{}
+	for _, v := range b.Versions {
+		if v.Status == VersionActive {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// Serves reports whether a version of the box is listed, and downloadable,
+// for a caller who can or cannot see unreleased versions.
+func (b Box) Serves(version string, unreleased bool) bool {
+	for _, v := range b.Versions {
+		if v.Version == version {
+			return v.Status == VersionActive || unreleased && v.Status == VersionUnreleased
+		}
+	}
+	return false
+}
+
+// ServedVersions returns a copy of the box listing only the versions Serves
+// allows. The copy shares nothing with the catalog, so it can be changed.
+func (b Box) ServedVersions(unreleased bool) Box {
+	versions := []Version{}
+	for _, v := range b.Versions {
+		if b.Serves(v.Version, unreleased) {
+			v.Providers = append([]Provider{}, v.Providers...)
+			versions = append(versions, v)
+		}
+	}
+	b.Versions = versions
+	b.CurrentVersion = currentVersion(b.Versions)
+	return b
 }
 
 func (bh *BoxHandler) BoxRegex() string {
-	return `(?P<owner>\w*)-VAGRANTSLASH-(?P<boxname>[a-zA-Z0-9]*)__(?P<version>[a-zA-Z0-9\.-]*)__(?P<provider>[a-zA-Z0-9]*).box`
+	if bh.FilenamePattern != "" {
+		return bh.FilenamePattern
+	}
+	return DefaultBoxRegex
+}
+
+// CheckBoxRegex makes sure the active filename pattern compiles and has the
+// named groups needed to build the catalog.
+func (bh *BoxHandler) CheckBoxRegex() error {
+	exp, err := regexp.Compile(bh.BoxRegex())
+	if err != nil {
+		return err
+	}
+	groups := map[string]bool{}
+	for _, name := range exp.SubexpNames() {
+		groups[name] = true
+	}
+	for _, required := range []string{"owner", "boxname", "version", "provider"} {
+		if !groups[required] {
+			return fmt.Errorf("box regex has no (?P<%s>...) group", required)
+		}
+	}
+	return nil
+}
+
+// BaseUrl is the address boxes and the API are served from, such as
+// https://boxes.example.com:8099.
+func (bh *BoxHandler) BaseUrl() string {
+	return bh.baseUrl(bh.Hostname, bh.Port)
+}
+
+func (bh *BoxHandler) baseUrl(hostname string, port int) string {
+	if bh.ExternalUrl != "" {
+		return bh.ExternalUrl
+	}
+	scheme := bh.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + hostname + ":" + strconv.Itoa(port)
+}
+
+// apiUrl builds an absolute URL below /api/v1 on this server.
+func (bh *BoxHandler) apiUrl(parts ...string) string {
+	return apiUrl(bh.BaseUrl(), parts...)
+}
+
+func apiUrl(base string, parts ...string) string {
+	return base + "/api/v1/" + strings.Join(parts, "/")
+}
+
+// Catalog returns the current snapshot of the catalog.
+func (bh *BoxHandler) Catalog() *Catalog {
+	if c, ok := bh.catalog.Load().(*Catalog); ok {
+		return c
+	}
+	return &Catalog{Boxes: make(map[string]map[string]Box)}
+}
+
+func (bh *BoxHandler) publishCatalog(c *Catalog) {
+	bh.catalog.Store(c)
+}
+
+// Boxes returns the boxes of the current snapshot, keyed by user then box.
+// The result must not be changed.
+func (bh *BoxHandler) Boxes() map[string]map[string]Box {
+	return bh.Catalog().Boxes
+}
+
+// Directories returns the absolute directories the current snapshot was
+// built from.
+func (bh *BoxHandler) Directories() []string {
+	return bh.Catalog().Directories
 }
 
 func (bh *BoxHandler) BoxAvailable(username string, boxname string) bool {
-	return (bh.Boxes[username][boxname].Username != "")
+	return (bh.Boxes()[username][boxname].Username != "")
 }
 
-func (bh *BoxHandler) GetBoxFileLocation(username string, boxName string, provider string, version string) string {
-	boxList := bh.Boxes[username][boxName]
-	for _, box := range boxList.Versions {
+func (bh *BoxHandler) GetBoxFileLocation(username string, boxName string, provider string, architecture string, version string) string {
+	for _, box := range bh.Boxes()[username][boxName].Versions {
 		if box.Version == version {
-			for _, boxprovider := range box.Providers {
-				if boxprovider.Name == provider {
-					return boxprovider.LocalBoxFile
-				}
-			}
+			boxprovider, _ := findProvider(box.Providers, provider, architecture)
+			return boxprovider.LocalBoxFile
 		}
 	}
 	return ""
 }
 
+// GetBoxFile returns the provider entry of an indexed box file. An empty
+// architecture finds the default architecture of the provider.
+func (bh *BoxHandler) GetBoxFile(username string, boxName string, provider string, architecture string, version string) (Provider, bool) {
+	for _, v := range bh.Boxes()[username][boxName].Versions {
+		if v.Version == version {
+			if p, ok := findProvider(v.Providers, provider, architecture); ok && p.Storage != nil {
+				return p, true
+			}
+		}
+	}
+	return Provider{}, false
+}
+
+// findProvider returns the provider with a name and architecture from a
+// version. An empty architecture finds a provider without one, or the
+// default architecture, or failing that the first of the name.
+func findProvider(providers []Provider, name string, architecture string) (Provider, bool) {
+	found := -1
+	for i, p := range providers {
+		if p.Name != name {
+			continue
+		}
+		if p.Architecture == architecture || architecture == "" && p.DefaultArchitecture {
+			return p, true
+		}
+		if architecture == "" && found == -1 {
+			found = i
+		}
+	}
+	if found == -1 {
+		return Provider{}, false
+	}
+	return providers[found], true
+}
+
+// GetBox returns a box from the current snapshot. Its versions and
+// providers are shared with the snapshot; use ServedVersions for a copy that
+// can be changed.
 func (bh *BoxHandler) GetBox(user string, boxName string) Box {
-	return bh.Boxes[user][boxName]
+	return bh.Boxes()[user][boxName]
+}
+
+// PublicBoxes returns the catalog without its private boxes, for pages that
+// are shown to anyone.
+func (bh *BoxHandler) PublicBoxes() map[string]map[string]Box {
+	boxes := make(map[string]map[string]Box)
+	for user, boxinfo := range bh.Boxes() {
+		for name, box := range boxinfo {
+			if box.Private {
+				continue
+			}
+			if boxes[user] == nil {
+				boxes[user] = make(map[string]Box)
+			}
+			boxes[user][name] = box
+		}
+	}
+	return boxes
 }
 
+// PopulateBoxes indexes every box in the directories given from scratch.
 func (bh *BoxHandler) PopulateBoxes(directories []string, port *int, hostname *string) {
-	log.Println("Populating boxes..")
-	absolutedirectories := []string{}
+	bh.indexMutex.Lock()
+	defer bh.indexMutex.Unlock()
+	logger.Debug("Populating boxes")
+	bh.sources = nil
+	bh.files = make(map[string]SimpleBox)
+	storages := []Storage{}
 	for _, d := range directories {
-		if !path.IsAbs(d) {
-			wd, _ := os.Getwd()
-			absolute := path.Clean(path.Join(wd, d))
-			absolutedirectories = append(absolutedirectories, absolute)
-		} else {
-			absolutedirectories = append(absolutedirectories, d)
+		source := indexSource{Directory: absoluteDirectory(d), Storage: bh.StorageFor(d), Tree: bh.IsTreeDirectory(d)}
+		bh.sources = append(bh.sources, source)
+		storages = append(storages, source.Storage)
+		for _, b := range bh.getStorageBoxData(source.Storage, source.Tree) {
+			bh.files[b.Location] = b
 		}
 	}
-	bh.Directories = absolutedirectories
-	boxfiles := getBoxList(absolutedirectories)
-	boxdata := bh.getBoxData(boxfiles)
-	bh.createBoxes(boxdata, *port, hostname)
+	bh.descriptors = loadDescriptors(storages)
+	bh.port = *port
+	bh.hostname = *hostname
+	boxes := bh.rebuild()
 
-	for _, boxinfo := range bh.Boxes {
+	count := 0
+	for _, boxinfo := range boxes {
+		count += len(boxinfo)
 		for boxname, box := range boxinfo {
 			for _, version := range box.Versions {
 				for _, provider := range version.Providers {
-					log.Println("Found " + box.Username + "/" + boxname + "/" + version.Version + "/" + provider.Name)
+					logger.Debug("Found box", "box", box.Username+"/"+boxname, "version", version.Version, "provider", provider.Name, "architecture", provider.Architecture)
 				}
 			}
 		}
 	}
+	logger.Info("Indexed boxes", "boxes", count, "files", len(bh.files))
 }
 
-// getBoxList returns a list of .box files in the directories provided.
-// Returns full path
-func getBoxList(directories []string) []string {
-	boxes := []string{}
-	for _, d := range directories {
-		log.Println("Checking for files in: " + d)
-		directoryglob := path.Join(d, "*.box")
-		files, _ := filepath.Glob(directoryglob)
-		boxes = append(boxes, files...)
+// markPrivateBoxes makes the boxes matching PrivateBoxes private, on top of
+// any marked private by their descriptor or when published.
+func (bh *BoxHandler) markPrivateBoxes(boxes map[string]map[string]Box) {
+	for user, boxinfo := range boxes {
+		for name, box := range boxinfo {
+			if isPrivateBox(bh.PrivateBoxes, box.Name) {
+				box.Private = true
+				boxes[user][name] = box
+			}
+		}
 	}
-	return boxes
+}
+
+// applyBoxCache publishes a new snapshot with whatever the box cache has
+// worked out since the last one. It is called by the cache as boxes are
+// processed.
+func (bh *BoxHandler) applyBoxCache() {
+	bh.indexMutex.Lock()
+	defer bh.indexMutex.Unlock()
+	c := bh.Catalog()
+	boxes := copyBoxes(c.Boxes)
+	bh.applyCache(boxes)
+	applyDefaultArchitectures(boxes)
+	bh.publishCatalog(&Catalog{Boxes: boxes, Directories: c.Directories})
+}
+
+// applyCache fills in provider checksums and archive metadata from the box
+// cache, queueing any box file that has not been processed yet.
+func (bh *BoxHandler) applyCache(boxes map[string]map[string]Box) {
+	if bh.Cache == nil {
+		return
+	}
+	for _, boxinfo := range boxes {
+		for _, box := range boxinfo {
+			for _, version := range box.Versions {
+				for j := range version.Providers {
+					provider := &version.Providers[j]
+					if provider.Storage == nil {
+						continue
+					}
+					entry, ok := bh.Cache.Lookup(provider.LocalBoxFile, provider.Object.Size, provider.Object.ModTime)
+					if !ok {
+						provider.Checksum = ""
+						provider.ChecksumType = ""
+						provider.Pending = true
+						bh.Cache.Queue(provider.Storage, provider.Object, provider.Name)
+						continue
+					}
+					provider.Checksum = entry.Sha256
+					provider.ChecksumType = "sha256"
+					provider.Pending = false
+					provider.Info = entry.Info
+					if entry.Metadata != nil {
+						if provider.Architecture == "" && entry.Metadata.Architecture != "" {
+							provider.Architecture = entry.Metadata.Architecture
+							provider.DownloadUrl = providerUrl(bh.baseUrl(bh.hostname, bh.port), box.Username, strings.TrimPrefix(box.Name, box.Username+"/"), version.Version, provider.Name, provider.Architecture)
+							provider.Url = provider.DownloadUrl
+						}
+						provider.Format = entry.Metadata.Format
+						provider.ArchiveProvider = entry.Metadata.Provider
+					}
+				}
+			}
+		}
+	}
+}
+
+// applyDefaultArchitectures marks one architecture of each provider of a
+// version as the default: amd64 if there is one, otherwise the first.
+func applyDefaultArchitectures(boxes map[string]map[string]Box) {
+	for _, boxinfo := range boxes {
+		for _, box := range boxinfo {
+			for _, version := range box.Versions {
+				defaults := map[string]int{}
+				for i, p := range version.Providers {
+					if p.Architecture == "" {
+						continue
+					}
+					if _, ok := defaults[p.Name]; !ok || p.Architecture == "amd64" {
+						defaults[p.Name] = i
+					}
+				}
+				for i := range version.Providers {
+					current, ok := defaults[version.Providers[i].Name]
+					version.Providers[i].DefaultArchitecture = ok && current == i
+				}
+			}
+		}
+	}
+}
+
+// copyBoxes returns a copy of a catalog's boxes that can be changed without
+// affecting the original.
+func copyBoxes(boxes map[string]map[string]Box) map[string]map[string]Box {
+	copied := make(map[string]map[string]Box)
+	for user, boxinfo := range boxes {
+		copied[user] = make(map[string]Box)
+		for name, box := range boxinfo {
+			versions := make([]Version, len(box.Versions))
+			for i, v := range box.Versions {
+				v.Providers = append([]Provider{}, v.Providers...)
+				versions[i] = v
+			}
+			box.Versions = versions
+			box.CurrentVersion = currentVersion(box.Versions)
+			copied[user][name] = box
+		}
+	}
+	return copied
+}
+
+func absoluteDirectory(d string) string {
+	if isRemoteDirectory(d) {
+		return d
+	}
+	if !path.IsAbs(d) {
+		wd, _ := os.Getwd()
+		return path.Clean(path.Join(wd, d))
+	}
+	return path.Clean(d)
+}
+
+// IsTreeDirectory reports whether boxes in a directory are laid out as
+// <user>/<box>/<version>/<provider>.box rather than by VAGRANTSLASH filename.
+func (bh *BoxHandler) IsTreeDirectory(directory string) bool {
+	directory = absoluteDirectory(directory)
+	for _, d := range bh.TreeDirectories {
+		if absoluteDirectory(d) == directory {
+			return true
+		}
+	}
+	return false
+}
+
+// BoxKey returns where a box belongs in a directory, following the layout of
+// that directory. It fails if the names could not be served back.
+func (bh *BoxHandler) BoxKey(directory string, username string, boxName string, version string, provider string, architecture string) (string, bool) {
+	if !validBoxName.MatchString(username) || !validBoxName.MatchString(boxName) || !validBoxVersion.MatchString(version) || !validBoxName.MatchString(provider) {
+		return "", false
+	}
+	name := provider
+	if architecture != "" {
+		if !validBoxName.MatchString(architecture) {
+			return "", false
+		}
+		name += "__" + architecture
+	}
+	if bh.IsTreeDirectory(directory) {
+		return username + "/" + boxName + "/" + version + "/" + name + ".box", true
+	}
+	// Make sure a configured filename pattern will find the box again.
+	filename := username + "-VAGRANTSLASH-" + boxName + "__" + version + "__" + name + ".box"
+	boxes := bh.getBoxData([]string{filename})
+	if len(boxes) != 1 {
+		return "", false
+	}
+	b := boxes[0]
+	if b.Username != username || b.Boxname != boxName || b.Version != version || b.Provider != provider || b.Architecture != architecture {
+		return "", false
+	}
+	return filename, true
+}
+
+// getStorageBoxData returns the boxes kept in a storage. Boxes are either
+// named by the filename pattern at the top of the storage, or laid out as
+// <user>/<box>/<version>/<provider>.box when tree is set.
+func (bh *BoxHandler) getStorageBoxData(s Storage, tree bool) []SimpleBox {
+	logger.Debug("Checking for files", "directory", s.Location(""))
+	objects, err := s.List(tree)
+	if err != nil {
+		logger.Warn("Could not list directory", "directory", s.Location(""), "error", err)
+	}
+	results := []SimpleBox{}
+	for _, o := range objects {
+		if b, ok := bh.storageBox(s, tree, o); ok {
+			results = append(results, b)
+		}
+	}
+	return results
+}
+
+// storageBox works out which box an object in a storage is, if any.
+func (bh *BoxHandler) storageBox(s Storage, tree bool, o StorageObject) (SimpleBox, bool) {
+	if path.Ext(o.Key) != ".box" {
+		return SimpleBox{}, false
+	}
+	location := s.Location(o.Key)
+	if !tree {
+		if strings.Contains(o.Key, "/") {
+			return SimpleBox{}, false
+		}
+		results := bh.getBoxData([]string{location})
+		if len(results) != 1 {
+			return SimpleBox{}, false
+		}
+		results[0].Storage = s
+		results[0].Object = o
+		return results[0], true
+	}
+
+	parts := strings.Split(o.Key, "/")
+	if len(parts) != 4 {
+		logger.Warn("Ignoring box outside of user/box/version/provider.box layout", "file", location)
+		return SimpleBox{}, false
+	}
+	provider := strings.TrimSuffix(parts[3], ".box")
+	architecture := ""
+	if i := strings.Index(provider, "__"); i != -1 {
+		provider, architecture = provider[:i], provider[i+2:]
+	}
+	if _, ok := bh.BoxKey(s.Location(""), parts[0], parts[1], parts[2], provider, architecture); !ok {
+		logger.Warn("Could not match metadata from path", "file", location)
+		return SimpleBox{}, false
+	}
+	return SimpleBox{Username: parts[0], Boxname: parts[1], Location: location, Provider: provider, Version: parts[2], Architecture: architecture, Storage: s, Object: o}, true
 }
 
 //getBoxData returns an array of SimpleBox objects based on Vagrant box files
 func (bh *BoxHandler) getBoxData(boxfiles []string) []SimpleBox {
 	results := []SimpleBox{}
 	var myExp = regexp.MustCompile(bh.BoxRegex())
+	groups := map[string]int{}
+	for i, name := range myExp.SubexpNames() {
+		if name != "" {
+			groups[name] = i
+		}
+	}
+	group := func(matches []string, name string) string {
+		if i, ok := groups[name]; ok {
+			return matches[i]
+		}
+		return ""
+	}
 	for _, b := range boxfiles {
 		matches := myExp.FindStringSubmatch(filepath.Base(b))
-		if matches == nil || len(matches) != 5 {
-			log.Println("Could not match metadata from filename: " + filepath.Base(b))
-			return results
+		if matches == nil {
+			logger.Warn("Could not match metadata from filename", "file", filepath.Base(b))
+			continue
+		}
+		newbox := SimpleBox{
+			Username:     group(matches, "owner"),
+			Boxname:      group(matches, "boxname"),
+			Location:     b,
+			Provider:     group(matches, "provider"),
+			Version:      group(matches, "version"),
+			Architecture: group(matches, "architecture"),
+		}
+		if newbox.Username == "" || newbox.Boxname == "" || newbox.Version == "" || newbox.Provider == "" {
+			logger.Warn("Could not match metadata from filename", "file", filepath.Base(b))
+			continue
 		}
-		newbox := SimpleBox{Username: matches[1], Boxname: matches[2], Location: b, Provider: matches[4], Version: matches[3]}
 		results = append(results, newbox)
 	}
 
 	return results
 }
 
-//Creates the data structure used to provide box data to Vagrant
+//Creates the data structure used to provide box data to Vagrant, replacing
+//the current catalog with it
 func (bh *BoxHandler) createBoxes(sb []SimpleBox, port int, hostname *string) {
+	bh.publishCatalog(&Catalog{Boxes: buildBoxes(sb, bh.baseUrl(*hostname, port)), Directories: bh.Directories()})
+}
+
+// buildBoxes groups box files into boxes and versions, with URLs below base.
+func buildBoxes(sb []SimpleBox, base string) map[string]map[string]Box {
 	boxes := make(map[string]map[string]Box)
 	for _, b := range sb {
 
@@ -168,13 +691,25 @@ func (bh *BoxHandler) createBoxes(sb []SimpleBox, port int, hostname *string) {
 			box.Username = b.Username
 			box.Private = false
 		}
+		// Published boxes have their own times, set when they are decorated.
+		modTime := b.Object.ModTime.UTC().Format(time.RFC3339)
+		if !b.Object.ModTime.IsZero() && (box.Created == "" || modTime < box.Created) {
+			box.Created = modTime
+		}
+		if !b.Object.ModTime.IsZero() && modTime > box.Updated {
+			box.Updated = modTime
+		}
 
 		provider := Provider{}
 		provider.Name = b.Provider
 		provider.Hosted = "true"
-		provider.DownloadUrl = "http://" + *hostname + ":" + strconv.Itoa(port) + "/" + b.Username + "/" + b.Boxname + "/" + b.Version + "/" + b.Provider + "/" + b.Provider + ".box"
+		provider.DownloadUrl = providerUrl(base, b.Username, b.Boxname, b.Version, b.Provider, b.Architecture)
 		provider.Url = provider.DownloadUrl
+		provider.UploadUrl = uploadUrl(base, b.Username, b.Boxname, b.Version, b.Provider, b.Architecture)
+		provider.Architecture = b.Architecture
 		provider.LocalBoxFile = b.Location
+		provider.Storage = b.Storage
+		provider.Object = b.Object
 
 		if len(box.Versions) > 0 {
 			providerAppended := false
@@ -186,31 +721,69 @@ func (bh *BoxHandler) createBoxes(sb []SimpleBox, port int, hostname *string) {
 			}
 			
 			if providerAppended == false {
-				newversion := Version{}
-				newversion.Status = "active"
-				newversion.Version = b.Version
-				newversion.Providers = []Provider{provider}
-				box.Versions = append(box.Versions, newversion)
+				box.Versions = append(box.Versions, newVersion(b, provider, base))
 			}
 		} else {
-			newversion := Version{}
-			newversion.Status = "active"
-			newversion.Version = b.Version
-			newversion.Providers = []Provider{provider}
-			box.Versions = []Version{newversion}
+			box.Versions = []Version{newVersion(b, provider, base)}
 		}
 
 		if boxes[b.Username] == nil {
 			boxes[b.Username] = make(map[string]Box)
 		}
 
-		sort.Slice(box.Versions[:], func(i, j int) bool {
-			return version.Compare(box.Versions[i].Version, box.Versions[j].Version, ">")
-		})
-		box.CurrentVersion = &box.Versions[0]
+		sortVersions(&box)
 
 		boxes[b.Username][b.Boxname] = box
 	}
 
-	bh.Boxes = boxes
+	return boxes
+}
+
+// providerUrl is where a box file is downloaded from. Providers with an
+// architecture have it as a path segment, so that architectures of the same
+// provider do not collide.
+func providerUrl(base string, username string, boxName string, version string, provider string, architecture string) string {
+	if architecture != "" {
+		return base + "/" + username + "/" + boxName + "/" + version + "/" + provider + "/" + architecture + "/" + provider + ".box"
+	}
+	return base + "/" + username + "/" + boxName + "/" + version + "/" + provider + "/" + provider + ".box"
+}
+
+// uploadUrl is the publishing API endpoint handing out upload paths for a
+// provider, which has the architecture after the provider when it has one.
+func uploadUrl(base string, username string, boxName string, version string, provider string, architecture string) string {
+	if architecture != "" {
+		return apiUrl(base, "box", username, boxName, "version", version, "provider", provider, architecture, "upload")
+	}
+	return apiUrl(base, "box", username, boxName, "version", version, "provider", provider, "upload")
+}
+
+func newVersion(b SimpleBox, provider Provider, base string) Version {
+	newversion := Version{}
+	newversion.Status = VersionActive
+	newversion.Version = b.Version
+	newversion.Providers = []Provider{provider}
+	newversion.ReleaseUrl = apiUrl(base, "box", b.Username, b.Boxname, "version", b.Version, "release")
+	newversion.RevokeUrl = apiUrl(base, "box", b.Username, b.Boxname, "version", b.Version, "revoke")
+	return newversion
+}
+
+// sortVersions orders the versions of a box newest first and points
+// CurrentVersion at the newest active one.
+func sortVersions(box *Box) {
+	sort.Slice(box.Versions[:], func(i, j int) bool {
+		return version.Compare(box.Versions[i].Version, box.Versions[j].Version, ">")
+	})
+	box.CurrentVersion = currentVersion(box.Versions)
+}
+
+// currentVersion returns the first active version of a sorted list that has
+// something to download.
+func currentVersion(versions []Version) *Version {
+	for i := range versions {
+		if versions[i].Status == VersionActive && len(versions[i].Providers) > 0 {
+			return &versions[i]
+		}
+	}
+	return nil
 }
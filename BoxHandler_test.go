@@ -1,7 +1,14 @@
 package main
 
 import (
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -33,7 +40,7 @@ func TestCanCreateTwoBoxesFromSimpleBoxes(t *testing.T) {
 		SimpleBox{Boxname: "uat", Username: "benphegan", Provider: "virtualbox", Version: "1.0"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal(2, len(bh.Boxes["benphegan"]))
+	assert.Equal(2, len(bh.Boxes()["benphegan"]))
 }
 
 func TestCreatesCorrectBoxFromSimpleBox(t *testing.T) {
@@ -42,7 +49,7 @@ func TestCreatesCorrectBoxFromSimpleBox(t *testing.T) {
 	boxes := []SimpleBox{SimpleBox{Boxname: "dev", Username: "benphegan", Provider: "virtualbox", Version: "2.0"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal(1, len(bh.Boxes["benphegan"]))
+	assert.Equal(1, len(bh.Boxes()["benphegan"]))
 	assert.Equal("2.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
 	assert.Equal(1, len(bh.GetBox("benphegan", "dev").CurrentVersion.Providers))
 }
@@ -92,8 +99,8 @@ func TestCorrectProvidersCreated(t *testing.T) {
 		SimpleBox{Boxname: "dev", Username: "benphegan", Provider: "virtualbox", Version: "4.1"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal(3, len(bh.Boxes["benphegan"]["dev"].Versions))
-	//assert.Equal("vmware",bh.Boxes["benphegan"]["dev"].Versions[1].Providers[0].Name)
+	assert.Equal(3, len(bh.Boxes()["benphegan"]["dev"].Versions))
+	//assert.Equal("vmware",bh.Boxes()["benphegan"]["dev"].Versions[1].Providers[0].Name)
 }
 
 func TestCanGetBoxFileLocationForCurrent(t *testing.T) {
@@ -104,7 +111,7 @@ func TestCanGetBoxFileLocationForCurrent(t *testing.T) {
 		SimpleBox{Boxname: "dev", Username: "benphegan", Provider: "virtualbox", Version: "4.1", Location: "/tmp/benphegan-VAGRANTSLASH-dev__4.1__virtualbox.box"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__4.1__virtualbox.box", bh.GetBoxFileLocation("benphegan", "dev", "virtualbox", "4.1"))
+	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__4.1__virtualbox.box", bh.GetBoxFileLocation("benphegan", "dev", "virtualbox", "", "4.1"))
 }
 
 func TestCanGetBoxFileLocationForSpecificProvider(t *testing.T) {
@@ -115,7 +122,7 @@ func TestCanGetBoxFileLocationForSpecificProvider(t *testing.T) {
 		SimpleBox{Boxname: "dev", Username: "benphegan", Provider: "virtualbox", Version: "4.1", Location: "/tmp/benphegan-VAGRANTSLASH-dev__4.1__virtualbox.box"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__1.0__vmware.box", bh.GetBoxFileLocation("benphegan", "dev", "vmware", "1.0"))
+	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__1.0__vmware.box", bh.GetBoxFileLocation("benphegan", "dev", "vmware", "", "1.0"))
 }
 
 func TestCanGetTwoProvidersForOneVersion(t *testing.T) {
@@ -125,8 +132,176 @@ func TestCanGetTwoProvidersForOneVersion(t *testing.T) {
 						SimpleBox{Boxname: "dev", Username: "benphegan", Provider: "vmware", Version: "2.0", Location: "/tmp/benphegan-VAGRANTSLASH-dev__2.0__vmware.box"}}
 	host := "localhost"
 	bh.createBoxes(boxes, 80, &host)
-	assert.Equal(2, len(bh.Boxes["benphegan"]["dev"].Versions[0].Providers))
-	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__2.0__vmware.box", bh.GetBoxFileLocation("benphegan", "dev", "vmware", "2.0"))
-	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box", bh.GetBoxFileLocation("benphegan", "dev", "virtualbox", "2.0"))
+	assert.Equal(2, len(bh.Boxes()["benphegan"]["dev"].Versions[0].Providers))
+	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__2.0__vmware.box", bh.GetBoxFileLocation("benphegan", "dev", "vmware", "", "2.0"))
+	assert.Equal("/tmp/benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box", bh.GetBoxFileLocation("benphegan", "dev", "virtualbox", "", "2.0"))
 }
 
+
+func TestCanFindBoxesInTreeLayout(t *testing.T) {
+	assert := assert.New(t)
+	flat, _ := ioutil.TempDir("", "vagrantshadow-flat")
+	defer os.RemoveAll(flat)
+	tree, _ := ioutil.TempDir("", "vagrantshadow-tree")
+	defer os.RemoveAll(tree)
+	ioutil.WriteFile(filepath.Join(flat, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte{}, 0644)
+	os.MkdirAll(filepath.Join(tree, "benphegan", "dev", "2.0"), 0755)
+	ioutil.WriteFile(filepath.Join(tree, "benphegan", "dev", "2.0", "vmware.box"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(tree, "benphegan", "stray.box"), []byte{}, 0644)
+
+	bh := BoxHandler{TreeDirectories: []string{tree}}
+	host := "localhost"
+	port := 80
+	bh.PopulateBoxes([]string{flat, tree}, &port, &host)
+	assert.Equal(2, len(bh.GetBox("benphegan", "dev").Versions))
+	assert.Equal("2.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+	assert.Equal(filepath.Join(tree, "benphegan", "dev", "2.0", "vmware.box"), bh.GetBoxFileLocation("benphegan", "dev", "vmware", "", "2.0"))
+	assert.Equal(filepath.Join(flat, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), bh.GetBoxFileLocation("benphegan", "dev", "virtualbox", "", "1.0"))
+}
+
+func TestBoxKeyFollowsDirectoryLayout(t *testing.T) {
+	assert := assert.New(t)
+	bh := BoxHandler{TreeDirectories: []string{"/srv/tree"}}
+	key, ok := bh.BoxKey("/srv/tree", "benphegan", "dev", "1.0", "virtualbox", "")
+	assert.True(ok)
+	assert.Equal("benphegan/dev/1.0/virtualbox.box", key)
+	key, ok = bh.BoxKey("/srv/flat", "benphegan", "dev", "1.0", "virtualbox", "")
+	assert.True(ok)
+	assert.Equal("benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box", key)
+}
+
+func TestArchitecturesOfAProviderDoNotCollide(t *testing.T) {
+	assert := assert.New(t)
+	flat, _ := ioutil.TempDir("", "vagrantshadow-flat")
+	defer os.RemoveAll(flat)
+	tree, _ := ioutil.TempDir("", "vagrantshadow-tree")
+	defer os.RemoveAll(tree)
+	ioutil.WriteFile(filepath.Join(flat, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox__arm64.box"), []byte("arm64 box"), 0644)
+	ioutil.WriteFile(filepath.Join(flat, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox__amd64.box"), []byte("amd64 box"), 0644)
+	os.MkdirAll(filepath.Join(tree, "benphegan", "dev", "2.0"), 0755)
+	ioutil.WriteFile(filepath.Join(tree, "benphegan", "dev", "2.0", "libvirt__arm64.box"), []byte("tree box"), 0644)
+
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, TreeDirectories: []string{tree}}
+	bh.PopulateBoxes([]string{flat, tree}, &port, &host)
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{architecture}/{boxfile}", downloadBox(bh)).Methods("GET")
+
+	version := bh.GetBox("benphegan", "dev").Versions[1]
+	assert.Equal(2, len(version.Providers))
+	urls := map[string]string{}
+	for _, p := range version.Providers {
+		urls[p.Architecture] = p.Url
+		assert.Equal(p.Architecture == "amd64", p.DefaultArchitecture)
+	}
+	assert.Equal("http://localhost:8099/benphegan/dev/1.0/virtualbox/amd64/virtualbox.box", urls["amd64"])
+	assert.Equal("http://localhost:8099/benphegan/dev/1.0/virtualbox/arm64/virtualbox.box", urls["arm64"])
+	assert.Equal("arm64", bh.GetBox("benphegan", "dev").Versions[0].Providers[0].Architecture)
+
+	assert.Equal("arm64 box", doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/arm64/virtualbox.box", "").Body.String())
+	assert.Equal("amd64 box", doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/amd64/virtualbox.box", "").Body.String())
+	assert.Equal("amd64 box", doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "").Body.String())
+	assert.Equal("tree box", doRequest(m, "GET", "/benphegan/dev/2.0/libvirt/libvirt.box", "").Body.String())
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/ppc64/virtualbox.box", "").Code)
+
+	key, ok := bh.BoxKey(flat, "benphegan", "dev", "1.0", "virtualbox", "arm64")
+	assert.True(ok)
+	assert.Equal("benphegan-VAGRANTSLASH-dev__1.0__virtualbox__arm64.box", key)
+	key, ok = bh.BoxKey(tree, "benphegan", "dev", "1.0", "virtualbox", "arm64")
+	assert.True(ok)
+	assert.Equal("benphegan/dev/1.0/virtualbox__arm64.box", key)
+}
+
+func TestDefaultRegexAcceptsVagrantNames(t *testing.T) {
+	assert := assert.New(t)
+	bh := BoxHandler{}
+	filenames := []string{
+		"/tmp/ben-phegan-VAGRANTSLASH-my-box__1.0.0-beta__vmware_desktop.box",
+		"/tmp/benphegan-VAGRANTSLASH-win_2019.core__2.0__hyperv-gen2.box",
+		"/tmp/benphegan-VAGRANTSLASH-dev__3.0__virtualbox__arm64.box",
+		"/tmp/benphegan-VAGRANTSLASH-dev.box",
+	}
+	boxes := bh.getBoxData(filenames)
+	assert.Equal(3, len(boxes), "Should skip the unmatched file and carry on")
+	assert.Equal("ben-phegan", boxes[0].Username)
+	assert.Equal("my-box", boxes[0].Boxname)
+	assert.Equal("1.0.0-beta", boxes[0].Version)
+	assert.Equal("vmware_desktop", boxes[0].Provider)
+	assert.Equal("win_2019.core", boxes[1].Boxname)
+	assert.Equal("hyperv-gen2", boxes[1].Provider)
+	assert.Equal("virtualbox", boxes[2].Provider)
+	assert.Equal("arm64", boxes[2].Architecture)
+}
+
+func TestCanConfigureFilenamePattern(t *testing.T) {
+	assert := assert.New(t)
+	bh := BoxHandler{FilenamePattern: `^(?P<owner>\w+)\.(?P<boxname>\w+)-(?P<version>[\d.]+)-(?P<provider>\w+)\.box$`}
+	assert.Nil(bh.CheckBoxRegex())
+	boxes := bh.getBoxData([]string{"/srv/boxes/benphegan.dev-1.2-libvirt.box"})
+	assert.Equal(1, len(boxes))
+	assert.Equal("libvirt", boxes[0].Provider)
+	assert.Equal("1.2", boxes[0].Version)
+}
+
+func TestRejectsFilenamePatternWithoutGroups(t *testing.T) {
+	assert := assert.New(t)
+	bh := BoxHandler{FilenamePattern: `^(?P<owner>\w+)-(?P<boxname>\w+)\.box$`}
+	assert.NotNil(bh.CheckBoxRegex())
+	bh.FilenamePattern = `(`
+	assert.NotNil(bh.CheckBoxRegex())
+}
+
+func TestCatalogCanBeReadWhileReindexing(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-stress")
+	defer os.RemoveAll(dir)
+	for _, v := range []string{"1.0", "1.1", "2.0"} {
+		ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__"+v+"__virtualbox.box"), []byte("box "+v), 0644)
+	}
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, RequestHost: true}
+	cache := BoxCache{Location: filepath.Join(dir, "cache.json"), OnUpdate: bh.applyBoxCache}
+	cache.Load()
+	bh.Cache = &cache
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	home := &HomePageTemplate{BoxHandler: bh}
+	home.TemplateString = home.GetDefaultTemplateString()
+
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, host)).Methods("GET")
+	m.Handle("/", showHomepage(home)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			bh.PopulateBoxes([]string{dir}, &port, &host)
+			bh.applyBoxCache()
+		}
+		done <- true
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, url := range []string{"/benphegan/dev", "/", "/benphegan/dev/1.1/virtualbox/virtualbox.box"} {
+					req, _ := http.NewRequest("GET", url, nil)
+					req.Host = "boxes.example.com"
+					w := httptest.NewRecorder()
+					m.ServeHTTP(w, req)
+					assert.Equal(http.StatusOK, w.Code, url)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+
+	box := bh.GetBox("benphegan", "dev")
+	assert.Equal("http://localhost:8099/benphegan/dev/2.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"path"
+	"strings"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+// BoxDescriptor is a sidecar file, named <user>-VAGRANTSLASH-<box>.yaml (or
+// .yml or .json), kept next to the box files to describe a box and carry the
+// release notes for each of its versions.
+type BoxDescriptor struct {
+	Username         string                       `yaml:"-" json:"-"`
+	Boxname          string                       `yaml:"-" json:"-"`
+	ShortDescription string                       `yaml:"short_description" json:"short_description"`
+	Description      string                       `yaml:"description" json:"description"`
+	Tags             []string                     `yaml:"tags" json:"tags"`
+	Private          *bool                        `yaml:"private" json:"private"`
+	Retention        *RetentionDescriptor         `yaml:"retention" json:"retention"`
+	Versions         map[string]VersionDescriptor `yaml:"versions" json:"versions"`
+}
+
+// RetentionDescriptor overrides the retention policy for a box. Rules that
+// are left out follow the policy given on the command line, and a rule set
+// to 0 is turned off.
+type RetentionDescriptor struct {
+	KeepVersions       *int `yaml:"keep_versions" json:"keep_versions"`
+	KeepDownloadedDays *int `yaml:"keep_downloaded_days" json:"keep_downloaded_days"`
+}
+
+type VersionDescriptor struct {
+	Description string `yaml:"description" json:"description"`
+}
+
+var descriptorExtensions = []string{".yaml", ".yml", ".json"}
+
+// isDescriptor reports whether a key names a descriptor file.
+func isDescriptor(key string) bool {
+	if strings.Contains(key, "/") || !strings.Contains(key, "-VAGRANTSLASH-") {
+		return false
+	}
+	for _, extension := range descriptorExtensions {
+		if path.Ext(key) == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDescriptor decodes a descriptor file, working out which box it
+// describes from its name.
+func parseDescriptor(name string, data []byte) (BoxDescriptor, error) {
+	descriptor := BoxDescriptor{}
+	extension := path.Ext(name)
+	var err error
+	if extension == ".json" {
+		err = json.Unmarshal(data, &descriptor)
+	} else {
+		err = yaml.Unmarshal(data, &descriptor)
+	}
+	if err != nil {
+		return descriptor, err
+	}
+	parts := strings.SplitN(strings.TrimSuffix(path.Base(name), extension), "-VAGRANTSLASH-", 2)
+	descriptor.Username = parts[0]
+	descriptor.Boxname = parts[1]
+	return descriptor, nil
+}
+
+// loadDescriptors reads every descriptor at the top of the storages
+// provided, keyed by location.
+func loadDescriptors(storages []Storage) map[string]BoxDescriptor {
+	descriptors := make(map[string]BoxDescriptor)
+	for _, s := range storages {
+		objects, _ := s.List(false)
+		for _, o := range objects {
+			if !isDescriptor(o.Key) {
+				continue
+			}
+			if descriptor, err := loadDescriptor(s, o.Key); err == nil {
+				descriptors[s.Location(o.Key)] = descriptor
+			}
+		}
+	}
+	return descriptors
+}
+
+// loadDescriptor reads a single descriptor, logging any problem with it.
+func loadDescriptor(s Storage, key string) (BoxDescriptor, error) {
+	data, err := readStorageObject(s, key)
+	if err != nil {
+		if err != ErrStorageObjectNotFound {
+			logger.Warn("Could not read descriptor", "file", s.Location(key), "error", err)
+		}
+		return BoxDescriptor{}, err
+	}
+	descriptor, err := parseDescriptor(key, data)
+	if err != nil {
+		logger.Warn("Could not read descriptor", "file", s.Location(key), "error", err)
+	}
+	return descriptor, err
+}
+
+// applyDescriptors merges descriptors into the catalog. Only boxes that exist
+// are described, and empty descriptor fields leave the catalog untouched.
+func applyDescriptors(boxes map[string]map[string]Box, descriptors map[string]BoxDescriptor) {
+	for _, descriptor := range descriptors {
+		box, ok := boxes[descriptor.Username][descriptor.Boxname]
+		if !ok {
+			continue
+		}
+		if descriptor.ShortDescription != "" {
+			box.ShortDescription = descriptor.ShortDescription
+		}
+		if descriptor.Description != "" {
+			box.DescriptionMarkdown = descriptor.Description
+		}
+		if len(descriptor.Tags) > 0 {
+			box.Tags = descriptor.Tags
+		}
+		if descriptor.Private != nil {
+			box.Private = *descriptor.Private
+		}
+		box.Retention = descriptor.Retention
+		for i, v := range box.Versions {
+			if vd, ok := descriptor.Versions[v.Version]; ok && vd.Description != "" {
+				box.Versions[i].DescriptionMarkdown = vd.Description
+			}
+		}
+		boxes[descriptor.Username][descriptor.Boxname] = box
+	}
+}
+
+// renderDescriptions fills in the HTML counterparts of every markdown
+// description in the catalog.
+func renderDescriptions(boxes map[string]map[string]Box) {
+	for user, boxinfo := range boxes {
+		for name, box := range boxinfo {
+			box.DescriptionHtml = renderMarkdown(box.DescriptionMarkdown)
+			for i := range box.Versions {
+				box.Versions[i].DescriptionHtml = renderMarkdown(box.Versions[i].DescriptionMarkdown)
+			}
+			boxes[user][name] = box
+		}
+	}
+}
+
+// DescriptionMarkup returns the rendered box description for templates. The
+// HTML is produced by renderMarkdown, which escapes its input.
+func (b Box) DescriptionMarkup() template.HTML {
+	return template.HTML(b.DescriptionHtml)
+}
+
+// DescriptionMarkup returns the rendered release notes for templates.
+func (v Version) DescriptionMarkup() template.HTML {
+	return template.HTML(v.DescriptionHtml)
+}
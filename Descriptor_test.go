@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestCanMergeYamlDescriptor(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-descriptor")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.10__virtualbox.box"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev.yaml"), []byte(`
+short_description: Development box
+description: |
+  # Dev
+  Built with **Packer**.
+tags: [ubuntu, dev]
+versions:
+  1.10:
+    description: |
+      - Upgraded kernel
+  "1.0":
+    description: First release
+`), 0644)
+
+	bh := BoxHandler{}
+	host := "localhost"
+	port := 80
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	box := bh.GetBox("benphegan", "dev")
+	assert.Equal("Development box", box.ShortDescription)
+	assert.Equal([]string{"ubuntu", "dev"}, box.Tags)
+	assert.Equal("<h1>Dev</h1>\n<p>Built with <strong>Packer</strong>.</p>", box.DescriptionHtml)
+	assert.Equal("1.10", box.CurrentVersion.Version)
+	assert.Equal("<ul>\n<li>Upgraded kernel</li>\n</ul>", box.CurrentVersion.DescriptionHtml)
+	assert.Equal("First release", box.Versions[1].DescriptionMarkdown)
+}
+
+func TestCanMergeJsonDescriptor(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-descriptor")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev.json"), []byte(`{"short_description": "Development box"}`), 0644)
+
+	bh := BoxHandler{}
+	host := "localhost"
+	port := 80
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	assert.Equal("Development box", bh.GetBox("benphegan", "dev").ShortDescription)
+}
+
+func TestMarkdownIsSanitised(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>", renderMarkdown("<script>alert(1)</script>"))
+	assert.Equal("<p>click</p>", renderMarkdown("[click](javascript:void)"))
+	assert.Equal(`<p><a href="https://example.com" rel="nofollow">docs</a></p>`, renderMarkdown("[docs](https://example.com)"))
+}
+
+func TestEmphasisLeavesLinksAndCodeAlone(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(`<p><a href="http://h/a_b_c" rel="nofollow">x</a></p>`, renderMarkdown("[x](http://h/a_b_c)"))
+	assert.Equal(`<p><a href="http://h/*a*" rel="nofollow"><em>x</em></a> and <strong>y</strong></p>`, renderMarkdown("[*x*](http://h/*a*) and **y**"))
+	assert.Equal(`<p><em>see <a href="https://h/a_b" rel="nofollow">docs</a></em></p>`, renderMarkdown("*see [docs](https://h/a_b)*"))
+	assert.Equal(`<p>set <code>my_var_name</code> and <code>*ptr*</code></p>`, renderMarkdown("set `my_var_name` and `*ptr*`"))
+}
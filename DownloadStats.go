@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadStats keeps the number of downloads of every box version, along
+// with a count per day, in a JSON file so that they survive restarts.
+// Downloads are written out, and OnUpdate called, at most once every
+// SaveInterval rather than on every download.
+type DownloadStats struct {
+	Location     string
+	SaveInterval time.Duration
+	OnUpdate     func()
+	counts       map[string]*DownloadCount
+	dirty        bool
+	mutex        sync.Mutex
+}
+
+// dailyDownloadDays is how many days of daily counts are kept, the longest
+// window they are reported over.
+const dailyDownloadDays = 30
+
+// DownloadCount is the download history of a box version. Daily is keyed by
+// UTC date, such as 2016-01-02, and holds the last dailyDownloadDays days.
+type DownloadCount struct {
+	Total int            `json:"total"`
+	Daily map[string]int `json:"daily"`
+	Last  time.Time      `json:"last_downloaded"`
+}
+
+// Load reads the statistics from disk and, if SaveInterval is set, starts
+// saving them in the background.
+func (ds *DownloadStats) Load() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.counts = make(map[string]*DownloadCount)
+	data, err := ioutil.ReadFile(ds.Location)
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		err = json.Unmarshal(data, &ds.counts)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, count := range ds.counts {
+		count.trim(now)
+	}
+	if ds.SaveInterval > 0 {
+		go ds.work()
+	}
+	return nil
+}
+
+// Record counts a download of a box version.
+func (ds *DownloadStats) Record(user string, box string, version string) {
+	if ds == nil {
+		return
+	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.counts == nil {
+		ds.counts = make(map[string]*DownloadCount)
+	}
+	key := user + "/" + box + "/" + version
+	count, ok := ds.counts[key]
+	if !ok {
+		count = &DownloadCount{Daily: make(map[string]int)}
+		ds.counts[key] = count
+	}
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+	if _, ok := count.Daily[day]; !ok {
+		count.trim(now)
+	}
+	count.Total++
+	count.Daily[day]++
+	count.Last = now
+	ds.dirty = true
+}
+
+// trim drops the daily counts from before the last dailyDownloadDays days.
+func (dc *DownloadCount) trim(now time.Time) {
+	if dc.Daily == nil {
+		dc.Daily = make(map[string]int)
+	}
+	oldest := now.AddDate(0, 0, -dailyDownloadDays).Format("2006-01-02")
+	for day := range dc.Daily {
+		if day < oldest {
+			delete(dc.Daily, day)
+		}
+	}
+}
+
+// Downloads returns the number of times a box version has been downloaded.
+func (ds *DownloadStats) Downloads(user string, box string, version string) int {
+	if ds == nil {
+		return 0
+	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if count, ok := ds.counts[user+"/"+box+"/"+version]; ok {
+		return count.Total
+	}
+	return 0
+}
+
+// LastDownloaded returns when a box version was last downloaded, or the zero
+// time if it never has been.
+func (ds *DownloadStats) LastDownloaded(user string, box string, version string) time.Time {
+	if ds == nil {
+		return time.Time{}
+	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if count, ok := ds.counts[user+"/"+box+"/"+version]; ok {
+		return count.Last
+	}
+	return time.Time{}
+}
+
+// Flush saves any downloads recorded since the last save and calls
+// OnUpdate.
+func (ds *DownloadStats) Flush() {
+	ds.mutex.Lock()
+	if !ds.dirty {
+		ds.mutex.Unlock()
+		return
+	}
+	ds.dirty = false
+	data, err := json.MarshalIndent(ds.counts, "", "  ")
+	ds.mutex.Unlock()
+	if err == nil {
+		err = ioutil.WriteFile(ds.Location+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(ds.Location+".tmp", ds.Location)
+	}
+	if err != nil {
+		logger.Error("Could not save download statistics", "file", ds.Location, "error", err)
+	}
+	if ds.OnUpdate != nil {
+		ds.OnUpdate()
+	}
+}
+
+func (ds *DownloadStats) work() {
+	for range time.Tick(ds.SaveInterval) {
+		ds.Flush()
+	}
+}
+
+// applyDownloadStats publishes a new snapshot with the current download
+// counts. It is called by the statistics as they are saved.
+func (bh *BoxHandler) applyDownloadStats() {
+	bh.indexMutex.Lock()
+	defer bh.indexMutex.Unlock()
+	c := bh.Catalog()
+	boxes := copyBoxes(c.Boxes)
+	bh.applyDownloads(boxes)
+	bh.publishCatalog(&Catalog{Boxes: boxes, Directories: c.Directories})
+}
+
+// applyDownloads fills in the download count of every version.
+func (bh *BoxHandler) applyDownloads(boxes map[string]map[string]Box) {
+	if bh.Stats == nil {
+		return
+	}
+	for user, boxinfo := range boxes {
+		for name, box := range boxinfo {
+			box.Downloads = 0
+			for i := range box.Versions {
+				box.Versions[i].Downloads = bh.Stats.Downloads(user, name, box.Versions[i].Version)
+				box.Downloads += box.Versions[i].Downloads
+			}
+			box.CurrentVersion = currentVersion(box.Versions)
+			boxinfo[name] = box
+		}
+	}
+}
+
+// statsCommand prints the download history of every box version, or of the
+// versions of the boxes given, oldest first so that versions that are no
+// longer used stand out.
+func statsCommand(location string, args []string) int {
+	ds := DownloadStats{Location: location}
+	if err := ds.Load(); err != nil {
+		logger.Error("Could not read download statistics", "error", err)
+		return 1
+	}
+	keys := []string{}
+	for key := range ds.counts {
+		parts := strings.SplitN(key, "/", 3)
+		if len(args) > 0 && !containsString(args, parts[0]+"/"+parts[1]) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return ds.counts[keys[i]].Last.Before(ds.counts[keys[j]].Last) })
+
+	recent := time.Now().UTC().AddDate(0, 0, -dailyDownloadDays)
+	for _, key := range keys {
+		count := ds.counts[key]
+		last30 := 0
+		for day, n := range count.Daily {
+			if t, err := time.Parse("2006-01-02", day); err == nil && t.After(recent) {
+				last30 += n
+			}
+		}
+		fmt.Println(key + "\t" + strconv.Itoa(count.Total) + " downloads\t" + strconv.Itoa(last30) + " in the last 30 days\tlast " + count.Last.Format("2006-01-02"))
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
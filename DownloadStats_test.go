@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestDownloadsAreCountedAndServed(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-stats")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("box contents"), 0644)
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port}
+	stats := DownloadStats{Location: filepath.Join(dir, "stats.json"), OnUpdate: bh.applyDownloadStats}
+	assert.Nil(stats.Load())
+	bh.Stats = &stats
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, host)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "")
+	doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "")
+	req, _ := http.NewRequest("GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", nil)
+	req.Header.Set("Range", "bytes=4-")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	doRequest(m, "GET", "/benphegan/dev/2.0/virtualbox/virtualbox.box", "")
+	stats.Flush()
+
+	var box Box
+	json.Unmarshal(doRequest(m, "GET", "/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal(2, box.Versions[0].Downloads)
+	assert.Equal(2, box.CurrentVersion.Downloads)
+
+	restarted := DownloadStats{Location: stats.Location}
+	assert.Nil(restarted.Load())
+	assert.Equal(2, restarted.Downloads("benphegan", "dev", "1.0"))
+	assert.Equal(2, restarted.counts["benphegan/dev/1.0"].Daily[time.Now().UTC().Format("2006-01-02")])
+	assert.Equal(0, restarted.Downloads("benphegan", "dev", "2.0"))
+	assert.Equal(0, statsCommand(stats.Location, []string{"benphegan/dev"}))
+}
+
+func TestOnlyRecentDailyCountsAreKept(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-stats")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "stats.json")
+	now := time.Now().UTC()
+	old := now.AddDate(0, 0, -dailyDownloadDays-1).Format("2006-01-02")
+	recent := now.AddDate(0, 0, -dailyDownloadDays+1).Format("2006-01-02")
+	data, _ := json.Marshal(map[string]*DownloadCount{
+		"benphegan/dev/1.0": {Total: 3, Daily: map[string]int{old: 2, recent: 1}},
+	})
+	ioutil.WriteFile(location, data, 0644)
+
+	stats := DownloadStats{Location: location}
+	assert.Nil(stats.Load())
+	assert.Equal(map[string]int{recent: 1}, stats.counts["benphegan/dev/1.0"].Daily)
+
+	stats.counts["benphegan/dev/1.0"].Daily[old] = 2
+	stats.Record("benphegan", "dev", "1.0")
+	assert.Equal(map[string]int{recent: 1, now.Format("2006-01-02"): 1}, stats.counts["benphegan/dev/1.0"].Daily)
+	assert.Equal(4, stats.Downloads("benphegan", "dev", "1.0"))
+}
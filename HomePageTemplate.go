@@ -2,7 +2,6 @@ package main
 
 import (
 	"io/ioutil"
-	"log"
 	"os"
 )
 
@@ -11,6 +10,13 @@ type HomePageTemplate struct {
 	BoxHandler     *BoxHandler
 }
 
+// homepageData is what the homepage template is run with: the handler, with
+// BaseUrl being the address of the request being answered.
+type homepageData struct {
+	*BoxHandler
+	BaseUrl string
+}
+
 func (ht *HomePageTemplate) GetDefaultTemplateString() string {
 	return `<html>
 		<h1>vagrantshadow</h1>
@@ -18,19 +24,37 @@ func (ht *HomePageTemplate) GetDefaultTemplateString() string {
 		<h2>Vagrant Configuration</h2>
 		<p>To use vagrantshadow with Vagrant:</p>
 		<ul>
-			<li><strong>Mac/Unix</strong> - <tt>export VAGRANT_SERVER_URL=http://{{ .Hostname }}:{{ .Port }}</tt></li>
-			<li><strong>Windows</strong> - <tt>set VAGRANT_SERVER_URL=http://{{ .Hostname }}:{{ .Port }}</tt></li>
+			<li><strong>Mac/Unix</strong> - <tt>export VAGRANT_SERVER_URL={{ .BaseUrl }}</tt></li>
+			<li><strong>Windows</strong> - <tt>set VAGRANT_SERVER_URL={{ .BaseUrl }}</tt></li>
 		</ul>
 		<h2>Available Boxes</h2>
-		{{ range $index, $element := .Boxes }}
+		{{ range $index, $element := .PublicBoxes }}
 			{{ range $key, $value := $element }}
-				{{ $value.Name }} <br>
+				<h3>{{ $value.Name }}{{ if $value.Pending }} <em>(pending)</em>{{ end }}</h3>
+				{{ if $value.ShortDescription }}<p>{{ $value.ShortDescription }}</p>{{ end }}
+				{{ $value.DescriptionMarkup }}
+				<ul>
+				{{ range $value.ActiveVersions }}
+					{{ $version := .Version }}
+					{{ $downloads := .Downloads }}
+					{{ range .Providers }}
+						<li>{{ $version }} - {{ .Name }} - {{ $downloads }} downloads{{ if .Architecture }} ({{ .Architecture }}){{ end }}{{ if .Format }} [{{ .Format }}]{{ end }}{{ if .ProviderMismatch }} <strong>metadata.json says {{ .ArchiveProvider }}</strong>{{ end }}</li>
+					{{ end }}
+					{{ .DescriptionMarkup }}
+				{{ end }}
+				</ul>
 			{{end }}
 		{{ end }}
 		<h2>Server Configuration</h2>
 		vagrantshadow will attempt to index and serve any file in the following filename structure:
 		<p/>
-			username-VAGRANTSHADOW-boxname__versionstring__provider.box
+			username-VAGRANTSHADOW-boxname__versionstring__provider.box (or __provider__architecture.box)
+		<p/>
+		or, in tree directories, any file laid out as:
+		<p/>
+			username/boxname/versionstring/provider.box
+		<p/>
+		Descriptions, release notes and tags for a box can be provided in a username-VAGRANTSLASH-boxname.yaml (or .json) file alongside its box files.
 		<p/>
 		versionstring can be any standard version string.  By default, vagrantshadow will make the highest version in the indexed directories the "current" version of a particular box.
 		<p/>
@@ -39,31 +63,32 @@ func (ht *HomePageTemplate) GetDefaultTemplateString() string {
 		 <tr><td>Hostname</td><td>{{ .Hostname }}</td></tr>
 		 <tr><td>Port</td><td>{{ .Port }}</td></tr>
 		 <tr><td>Box Regex</td><td>{{ .BoxRegex }}</td></tr>
-		 <tr><td>Directories</td><td>{{ .Directories }}</td></tr>	 
+		 <tr><td>Directories</td><td>{{ .Directories }}</td></tr>
+		 <tr><td>Tree Directories</td><td>{{ .TreeDirectories }}</td></tr>
 		</table>
 		<h2>Statistics</h2>
-		<a HREF="http://{{ .Hostname }}:{{ .Port }}/debug/vars">Debug Variables</a>
+		<a HREF="{{ .BaseUrl }}/debug/vars">Debug Variables</a>
 	</html>`
 }
 
 func (ht *HomePageTemplate) OutputTemplateString(location string) {
 	if _, err := os.Stat(location); os.IsNotExist(err) {
-		log.Println("Writing out default home template file: " + location)
+		logger.Info("Writing out default home template file", "file", location)
 		err := ioutil.WriteFile(location, []byte(ht.GetDefaultTemplateString()), 0644)
 		if err != nil {
-			log.Println("Failed to write default template to: " + location + " - " + err.Error())
+			logger.Error("Failed to write default template", "file", location, "error", err)
 		}
 	} else {
-		log.Println("Default template exists on disk already")
+		logger.Info("Default template exists on disk already")
 	}
 }
 
 func (ht *HomePageTemplate) GetTemplateString(location string) string {
 	if _, err := os.Stat(location); err == nil {
-		log.Println("Found template file: " + location)
+		logger.Info("Found template file", "file", location)
 		templatetext, err := ioutil.ReadFile(location)
 		if err != nil {
-			log.Println("Could not load template: " + location)
+			logger.Error("Could not load template", "file", location, "error", err)
 			return ht.GetDefaultTemplateString()
 		}
 		template := string(templatetext)
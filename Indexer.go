@@ -0,0 +1,242 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexSource is one of the directories the catalog is built from.
+type indexSource struct {
+	Directory string
+	Storage   Storage
+	Tree      bool
+}
+
+// rebuild builds and publishes a catalog from the index state. Must be
+// called with the index mutex held.
+func (bh *BoxHandler) rebuild() map[string]map[string]Box {
+	locations := make([]string, 0, len(bh.files))
+	for location := range bh.files {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	boxdata := make([]SimpleBox, 0, len(locations))
+	directories := make([]string, 0, len(bh.sources))
+	for _, location := range locations {
+		boxdata = append(boxdata, bh.files[location])
+	}
+	for _, source := range bh.sources {
+		directories = append(directories, source.Directory)
+	}
+
+	boxes := buildBoxes(boxdata, bh.baseUrl(bh.hostname, bh.port))
+	if bh.Publisher != nil {
+		bh.Publisher.Decorate(boxes)
+	}
+	applyDescriptors(boxes, bh.descriptors)
+	renderDescriptions(boxes)
+	bh.markPrivateBoxes(boxes)
+	bh.applyCache(boxes)
+	applyDefaultArchitectures(boxes)
+	bh.applyDownloads(boxes)
+	bh.publishCatalog(&Catalog{Boxes: boxes, Directories: directories})
+	return boxes
+}
+
+// IndexFiles updates the catalog for files that have changed on disk,
+// re-reading only those files. Growing files are dropped from the catalog
+// until they are passed in changed once they have settled. Changes the index
+// cannot follow file by file, such as a directory appearing, trigger a full
+// reindex of the directories last given to PopulateBoxes. Changes to files
+// the catalog is not built from, such as the download statistics, are
+// ignored.
+func (bh *BoxHandler) IndexFiles(changed []string, growing []string) {
+	bh.indexMutex.Lock()
+	if bh.files == nil {
+		bh.indexMutex.Unlock()
+		return
+	}
+	rescan := false
+	rebuild := false
+	for _, location := range growing {
+		if _, ok := bh.files[location]; ok {
+			logger.Info("Hiding box while it is written", "file", location)
+			delete(bh.files, location)
+			rebuild = true
+		}
+	}
+	for _, location := range changed {
+		indexed, ok := bh.indexFile(location)
+		rebuild = rebuild || indexed
+		rescan = rescan || !ok
+	}
+	if !rescan {
+		if rebuild {
+			bh.rebuild()
+		}
+		bh.indexMutex.Unlock()
+		return
+	}
+
+	directories := []string{}
+	for _, source := range bh.sources {
+		directories = append(directories, source.Directory)
+	}
+	port, hostname := bh.port, bh.hostname
+	bh.indexMutex.Unlock()
+	bh.PopulateBoxes(directories, &port, &hostname)
+}
+
+// indexFile re-reads a single changed file into the index state. It reports
+// whether the file is one the catalog is built from, and returns ok false if
+// the change needs a full reindex. Must be called with the index mutex held.
+func (bh *BoxHandler) indexFile(location string) (indexed bool, ok bool) {
+	for _, source := range bh.sources {
+		fs, ok := source.Storage.(*FileStorage)
+		if !ok || !strings.HasPrefix(location, fs.Root+string(filepath.Separator)) {
+			continue
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(location, fs.Root+string(filepath.Separator)))
+		object, err := source.Storage.Stat(key)
+		found := err == nil
+
+		if isDescriptor(key) && !source.Tree {
+			delete(bh.descriptors, location)
+			if found {
+				if descriptor, err := loadDescriptor(source.Storage, key); err == nil {
+					bh.descriptors[location] = descriptor
+				}
+			}
+			return true, true
+		}
+		if filepath.Ext(key) == ".box" {
+			delete(bh.files, location)
+			if found {
+				if b, ok := bh.storageBox(source.Storage, source.Tree, object); ok {
+					logger.Info("Indexed box", "file", location)
+					bh.files[location] = b
+				}
+			} else {
+				logger.Info("Removed box", "file", location)
+			}
+			return true, true
+		}
+		// The publish records are read again when the catalog is rebuilt.
+		// Other files, such as the download statistics, play no part in it.
+		records := key == publishRecordFile
+		if found {
+			return records, true
+		}
+		// Anything else that vanished may have been a directory of boxes.
+		for file := range bh.files {
+			if strings.HasPrefix(file, location+string(filepath.Separator)) {
+				return true, false
+			}
+		}
+		return records, true
+	}
+	return false, true
+}
+
+// Reindexer collects file system changes and hands them to IndexFiles once
+// they have been quiet for Window, so that copying a box in does not cause a
+// reindex per write. A file that was written to, rather than only created or
+// renamed into place, is held back until its size and modification time are
+// the same on two checks a Window apart.
+type Reindexer struct {
+	BoxHandler *BoxHandler
+	Window     time.Duration
+	// Rescan is called instead of IndexFiles for changes that are not to a
+	// single file, such as a new directory.
+	Rescan   func()
+	changes  map[string]bool
+	rescan   bool
+	settling map[string]StorageObject
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+// Changed records a change to location. written is set when the file's
+// contents were written to in place.
+func (ri *Reindexer) Changed(location string, written bool) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+	if ri.changes == nil {
+		ri.changes = make(map[string]bool)
+	}
+	ri.changes[location] = ri.changes[location] || written
+	ri.schedule()
+}
+
+// RescanAll asks for a full reindex once things are quiet.
+func (ri *Reindexer) RescanAll() {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+	ri.rescan = true
+	ri.schedule()
+}
+
+// schedule must be called with the mutex held.
+func (ri *Reindexer) schedule() {
+	if ri.timer == nil {
+		ri.timer = time.AfterFunc(ri.Window, ri.flush)
+		return
+	}
+	ri.timer.Reset(ri.Window)
+}
+
+func (ri *Reindexer) flush() {
+	ri.mutex.Lock()
+	if ri.settling == nil {
+		ri.settling = make(map[string]StorageObject)
+	}
+	changes := ri.changes
+	rescan := ri.rescan
+	ri.changes = make(map[string]bool)
+	ri.rescan = false
+	for location := range ri.settling {
+		if _, ok := changes[location]; !ok {
+			changes[location] = true
+		}
+	}
+
+	changed := []string{}
+	growing := []string{}
+	for location, written := range changes {
+		if !written || filepath.Ext(location) != ".box" {
+			delete(ri.settling, location)
+			changed = append(changed, location)
+			continue
+		}
+		object, err := (&FileStorage{Root: filepath.Dir(location)}).Stat(filepath.Base(location))
+		if err != nil {
+			delete(ri.settling, location)
+			changed = append(changed, location)
+			continue
+		}
+		previous, seen := ri.settling[location]
+		if seen && previous.Size == object.Size && previous.ModTime.Equal(object.ModTime) {
+			delete(ri.settling, location)
+			changed = append(changed, location)
+			continue
+		}
+		ri.settling[location] = object
+		growing = append(growing, location)
+	}
+	if len(ri.settling) > 0 {
+		ri.schedule()
+	}
+	ri.mutex.Unlock()
+
+	sort.Strings(changed)
+	if rescan && ri.Rescan != nil {
+		ri.Rescan()
+		changed = nil
+	}
+	if len(changed) > 0 || len(growing) > 0 {
+		ri.BoxHandler.IndexFiles(changed, growing)
+	}
+}
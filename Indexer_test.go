@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func newIndexedDirectory(t *testing.T) (*BoxHandler, string) {
+	dir, err := ioutil.TempDir("", "vagrantshadow-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("one"), 0644)
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port}
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	return bh, dir
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the index")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIndexFilesOnlyRereadsChangedFiles(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	added := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box")
+	unreported := filepath.Join(dir, "benphegan-VAGRANTSLASH-other__1.0__virtualbox.box")
+	ioutil.WriteFile(added, []byte("two"), 0644)
+	ioutil.WriteFile(unreported, []byte("other"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev.yaml"), []byte("short_description: Development box\n"), 0644)
+
+	bh.IndexFiles([]string{added, filepath.Join(dir, "benphegan-VAGRANTSLASH-dev.yaml")}, nil)
+	assert.Equal("2.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+	assert.Equal("Development box", bh.GetBox("benphegan", "dev").ShortDescription)
+	assert.False(bh.BoxAvailable("benphegan", "other"))
+
+	os.Remove(added)
+	bh.IndexFiles([]string{added}, nil)
+	assert.Equal("1.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+
+	bh.IndexFiles(nil, []string{filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box")})
+	assert.False(bh.BoxAvailable("benphegan", "dev"))
+}
+
+func TestIndexFilesIgnoresFilesOutsideTheCatalog(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	catalog := bh.Catalog()
+	stats := filepath.Join(dir, ".vagrantshadow-stats.json")
+	ioutil.WriteFile(stats+".tmp", []byte("{}"), 0644)
+	bh.IndexFiles([]string{stats + ".tmp"}, nil)
+	os.Rename(stats+".tmp", stats)
+	bh.IndexFiles([]string{stats + ".tmp", stats}, nil)
+	assert.True(catalog == bh.Catalog())
+
+	ioutil.WriteFile(filepath.Join(dir, publishRecordFile), []byte("{}"), 0644)
+	bh.IndexFiles([]string{filepath.Join(dir, publishRecordFile)}, nil)
+	assert.False(catalog == bh.Catalog())
+}
+
+func TestReindexerWaitsForWrittenFilesToSettle(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	ri := &Reindexer{BoxHandler: bh, Window: 200 * time.Millisecond}
+
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box")
+	f, _ := os.Create(location)
+	f.Write([]byte("first"))
+	ri.Changed(location, true)
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal("1.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+	f.Write([]byte(" second"))
+	f.Close()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("1.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+
+	waitFor(t, func() bool { return bh.GetBox("benphegan", "dev").CurrentVersion.Version == "2.0" })
+	provider, _ := bh.GetBoxFile("benphegan", "dev", "virtualbox", "", "2.0")
+	assert.Equal(int64(12), provider.Object.Size)
+}
+
+func TestReindexerIndexesRenamedFilesAtOnce(t *testing.T) {
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	ri := &Reindexer{BoxHandler: bh, Window: 10 * time.Millisecond}
+
+	partial := filepath.Join(dir, ".upload.part")
+	location := filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box")
+	ioutil.WriteFile(partial, []byte("two"), 0644)
+	os.Rename(partial, location)
+	ri.Changed(location, false)
+
+	waitFor(t, func() bool { return bh.GetBox("benphegan", "dev").CurrentVersion.Version == "2.0" })
+}
+
+func TestReindexerCoalescesChanges(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	var rescans int32
+	ri := &Reindexer{BoxHandler: bh, Window: 50 * time.Millisecond, Rescan: func() { atomic.AddInt32(&rescans, 1) }}
+
+	for i := 0; i < 100; i++ {
+		ri.RescanAll()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&rescans) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&rescans))
+}
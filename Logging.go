@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// parseLevel reads a -log-level value.
+func parseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("log level must be one of " + strings.Join(levelNames, ", "))
+}
+
+// Logger writes entries made of a message and key value pairs, such as
+// logger.Warn("Could not read descriptor", "file", location, "error", err).
+// Entries below Level are dropped. Format is "text", which is meant for
+// people, "logfmt" or "json".
+type Logger struct {
+	Level  Level
+	Format string
+	Output io.Writer
+	mutex  sync.Mutex
+}
+
+var logger = &Logger{Level: LevelInfo, Format: "text", Output: os.Stderr}
+
+var logFormats = []string{"text", "logfmt", "json"}
+
+// checkLogFormat checks a -log-format value.
+func checkLogFormat(format string) error {
+	for _, f := range logFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return errors.New("log format must be one of " + strings.Join(logFormats, ", "))
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if level < l.Level {
+		return
+	}
+	now := time.Now()
+	var buf bytes.Buffer
+	switch l.Format {
+	case "json":
+		buf.WriteString(`{"time":`)
+		writeJsonValue(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJsonValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJsonValue(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJsonValue(&buf, fieldKey(fields, i))
+			buf.WriteByte(':')
+			writeJsonValue(&buf, fieldValue(fields, i))
+		}
+		buf.WriteByte('}')
+	case "logfmt":
+		buf.WriteString("time=" + now.Format(time.RFC3339Nano) + " level=" + level.String() + " msg=" + logfmtValue(msg))
+		writeLogfmtFields(&buf, fields)
+	default:
+		buf.WriteString(now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level.String()) + " " + msg)
+		writeLogfmtFields(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.Output.Write(buf.Bytes())
+}
+
+func fieldKey(fields []interface{}, i int) string {
+	return fmt.Sprint(fields[i])
+}
+
+// fieldValue returns the value for the key at i, which is missing if the
+// fields are unbalanced.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i+1 >= len(fields) {
+		return nil
+	}
+	switch value := fields[i+1].(type) {
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return fields[i+1]
+}
+
+func writeJsonValue(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		value := fieldValue(fields, i)
+		text := ""
+		if value != nil {
+			text = fmt.Sprint(value)
+		}
+		buf.WriteString(" " + fieldKey(fields, i) + "=" + logfmtValue(text))
+	}
+}
+
+// logfmtValue quotes values that would otherwise be ambiguous.
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, r := range value {
+		if r == ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// logWriter passes the output of the standard library's logger, such as the
+// HTTP server's errors, on to a Logger.
+type logWriter struct {
+	Logger *Logger
+	Level  Level
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.Logger.log(lw.Level, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+// AccessLog records every request, in Combined Log Format followed by the
+// time taken in seconds, or as JSON.
+type AccessLog struct {
+	Output     io.Writer
+	Format     string
+	BoxHandler *BoxHandler
+	mutex      sync.Mutex
+}
+
+// AccessLogEntry is a request as written to a JSON access log.
+type AccessLogEntry struct {
+	Time      string  `json:"time"`
+	ClientIp  string  `json:"client_ip"`
+	Method    string  `json:"method"`
+	Uri       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Host      string  `json:"host"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer"`
+	UserAgent string  `json:"user_agent"`
+}
+
+// checkAccessLogFormat checks an -access-log-format value.
+func checkAccessLogFormat(format string) error {
+	if format != "combined" && format != "json" {
+		return errors.New("access log format must be combined or json")
+	}
+	return nil
+}
+
+// logRequests writes a line to the access log for every request h serves.
+func logRequests(al *AccessLog, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rr := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rr, r)
+		if rr.Status == 0 {
+			rr.Status = http.StatusOK
+		}
+		al.Write(AccessLogEntry{
+			Time:      start.Format(time.RFC3339Nano),
+			ClientIp:  al.BoxHandler.clientIp(r),
+			Method:    r.Method,
+			Uri:       r.RequestURI,
+			Protocol:  r.Proto,
+			Host:      r.Host,
+			Status:    rr.Status,
+			Bytes:     rr.Written,
+			Duration:  time.Since(start).Seconds(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Write adds an entry to the access log.
+func (al *AccessLog) Write(entry AccessLogEntry) {
+	var line []byte
+	if al.Format == "json" {
+		line, _ = json.Marshal(entry)
+	} else {
+		timestamp := entry.Time
+		if t, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil {
+			timestamp = t.Format("02/Jan/2006:15:04:05 -0700")
+		}
+		bytesSent := "-"
+		if entry.Bytes > 0 {
+			bytesSent = strconv.FormatInt(entry.Bytes, 10)
+		}
+		line = []byte(entry.ClientIp + " - - [" + timestamp + "] " +
+			combinedQuote(entry.Method+" "+entry.Uri+" "+entry.Protocol) + " " +
+			strconv.Itoa(entry.Status) + " " + bytesSent + " " +
+			combinedQuote(entry.Referer) + " " + combinedQuote(entry.UserAgent) + " " +
+			strconv.FormatFloat(entry.Duration, 'f', 3, 64))
+	}
+	line = append(line, '\n')
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.Output.Write(line)
+}
+
+// combinedQuote quotes a Combined Log Format field, escaping anything a
+// client could use to forge a line.
+func combinedQuote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+// RotatingFile is a log file that is renamed to Path.1, with older files
+// moved up to Path.<Backups>, when a write would take it past MaxSize bytes.
+// A MaxSize of 0 never rotates it, which suits rotation by logrotate followed
+// by a call to Reopen.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+	file    *os.File
+	size    int64
+	mutex   sync.Mutex
+}
+
+// Reopen closes the file, if it is open, and opens Path again.
+func (rf *RotatingFile) Reopen() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.open()
+}
+
+func (rf *RotatingFile) open() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+	file, err := os.OpenFile(rf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate must be called with the mutex held.
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	if rf.Backups > 0 {
+		os.Remove(rf.Path + "." + strconv.Itoa(rf.Backups))
+		for i := rf.Backups - 1; i > 0; i-- {
+			os.Rename(rf.Path+"."+strconv.Itoa(i), rf.Path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(rf.Path, rf.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.Path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// reopenOnHangup reopens a log file whenever the process is sent SIGHUP.
+func reopenOnHangup(rf *RotatingFile) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := rf.Reopen(); err != nil {
+				logger.Error("Could not reopen log file", "file", rf.Path, "error", err)
+			}
+		}
+	}()
+}
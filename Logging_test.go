@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestLoggerWritesLevelledStructuredEntries(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	l := &Logger{Level: LevelInfo, Format: "logfmt", Output: &buf}
+	l.Debug("Queried for box", "box", "benphegan/dev")
+	assert.Equal("", buf.String())
+
+	l.Warn("Could not read descriptor", "file", "/boxes/a b.yaml", "error", errors.New("bad yaml"), "count", 2)
+	assert.Regexp(`^time=\S+ level=warn msg="Could not read descriptor" file="/boxes/a b.yaml" error="bad yaml" count=2\n$`, buf.String())
+
+	buf.Reset()
+	l.Format = "json"
+	l.Error("Upload failed", "file", "x.box", "bytes", int64(10), "odd")
+	entry := map[string]interface{}{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal("error", entry["level"])
+	assert.Equal("Upload failed", entry["msg"])
+	assert.Equal("x.box", entry["file"])
+	assert.Equal(float64(10), entry["bytes"])
+	assert.Nil(entry["odd"])
+
+	level, err := parseLevel("DEBUG")
+	assert.Nil(err)
+	assert.Equal(LevelDebug, level)
+	_, err = parseLevel("verbose")
+	assert.NotNil(err)
+	assert.NotNil(checkLogFormat("xml"))
+}
+
+func TestAccessLogRecordsEachRequest(t *testing.T) {
+	assert := assert.New(t)
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	var buf bytes.Buffer
+	al := &AccessLog{Output: &buf, Format: "combined", BoxHandler: &BoxHandler{TrustedProxies: proxies}}
+	h := logRequests(al, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			notFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest("GET", "/benphegan/dev?x=1", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	req.Header.Set("User-Agent", `Vagrant/2.4 "quoted"`)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(`^203\.0\.113\.9 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /benphegan/dev\?x=1 HTTP/1\.1" 200 5 "-" "Vagrant/2\.4 \\"quoted\\"" \d+\.\d{3}\n$`, buf.String())
+
+	buf.Reset()
+	al.Format = "json"
+	req = httptest.NewRequest("GET", "/missing", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 10.4.4.4")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	entry := AccessLogEntry{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal("198.51.100.1", entry.ClientIp)
+	assert.Equal(http.StatusNotFound, entry.Status)
+	assert.Equal("/missing", entry.Uri)
+	assert.True(entry.Bytes > 0)
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("Forwarded", `for="[2001:db8::1]:4711";proto=https`)
+	assert.Equal("2001:db8::1", al.BoxHandler.clientIp(req))
+}
+
+func TestRotatingFileKeepsBackups(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-logs")
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "access.log")
+	rf := &RotatingFile{Path: location, MaxSize: 10, Backups: 2}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err := rf.Write([]byte(line))
+		assert.Nil(err)
+	}
+	read := func(name string) string {
+		contents, _ := ioutil.ReadFile(name)
+		return string(contents)
+	}
+	assert.Equal("six\n", read(location))
+	assert.Equal("four\nfive\n", read(location+".1"))
+	assert.Equal("three\n", read(location+".2"))
+	_, err := os.Stat(location + ".3")
+	assert.True(os.IsNotExist(err))
+
+	os.Rename(location, location+".moved")
+	assert.Nil(rf.Reopen())
+	rf.Write([]byte("seven\n"))
+	assert.Equal("seven\n", read(location))
+	assert.True(strings.HasPrefix(read(location+".moved"), "six"))
+}
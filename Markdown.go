@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+var markdownBullet = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+var markdownNumbered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+var markdownCode = regexp.MustCompile("`([^`]+)`")
+var markdownLink = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+var markdownStrong = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+var markdownEmphasis = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+
+// renderMarkdown turns the markdown used in box descriptions and release notes
+// into HTML. Only a small subset of markdown is understood (headings, lists,
+// code, emphasis and links) and all input is escaped before any markup is
+// added, so the result is safe to embed in a page as is.
+func renderMarkdown(source string) string {
+	if strings.TrimSpace(source) == "" {
+		return ""
+	}
+	var out []string
+	var paragraph []string
+	list := ""
+	inCode := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out = append(out, "<p>"+strings.Join(paragraph, "\n")+"</p>")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out = append(out, "</"+list+">")
+			list = ""
+		}
+	}
+	openList := func(kind string) {
+		if list != kind {
+			closeList()
+			out = append(out, "<"+kind+">")
+			list = kind
+		}
+	}
+
+	for _, line := range strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flushParagraph()
+			closeList()
+			if inCode {
+				out = append(out, "</code></pre>")
+			} else {
+				out = append(out, "<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out = append(out, html.EscapeString(line))
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flushParagraph()
+			closeList()
+			continue
+		}
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			closeList()
+			level := string('0' + rune(len(m[1])))
+			out = append(out, "<h"+level+">"+renderInlineMarkdown(m[2])+"</h"+level+">")
+			continue
+		}
+		if m := markdownBullet.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			openList("ul")
+			out = append(out, "<li>"+renderInlineMarkdown(m[1])+"</li>")
+			continue
+		}
+		if m := markdownNumbered.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			openList("ol")
+			out = append(out, "<li>"+renderInlineMarkdown(m[1])+"</li>")
+			continue
+		}
+		closeList()
+		paragraph = append(paragraph, renderInlineMarkdown(strings.TrimSpace(line)))
+	}
+	flushParagraph()
+	closeList()
+	if inCode {
+		out = append(out, "</code></pre>")
+	}
+	return strings.Join(out, "\n")
+}
+
+var markdownPlaceholder = regexp.MustCompile("\x00([0-9]+)\x00")
+
+func renderInlineMarkdown(text string) string {
+	text = html.EscapeString(strings.Replace(text, "\x00", "", -1))
+	// Code spans and the tags of links are set aside while emphasis is
+	// added, so that underscores and asterisks in them are left alone.
+	var markup []string
+	setAside := func(s string) string {
+		markup = append(markup, s)
+		return "\x00" + strconv.Itoa(len(markup)-1) + "\x00"
+	}
+	text = markdownCode.ReplaceAllStringFunc(text, func(code string) string {
+		return setAside("<code>" + markdownCode.FindStringSubmatch(code)[1] + "</code>")
+	})
+	text = markdownLink.ReplaceAllStringFunc(text, func(link string) string {
+		m := markdownLink.FindStringSubmatch(link)
+		target := html.UnescapeString(m[2])
+		lower := strings.ToLower(target)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "mailto:") {
+			return m[1]
+		}
+		return setAside(`<a href="`+html.EscapeString(target)+`" rel="nofollow">`) + m[1] + setAside("</a>")
+	})
+	text = markdownStrong.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = markdownEmphasis.ReplaceAllString(text, "<em>$1$2</em>")
+	return markdownPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		i, _ := strconv.Atoi(markdownPlaceholder.FindStringSubmatch(placeholder)[1])
+		return markup[i]
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// requestDurationBuckets are the upper bounds, in seconds, of the request
+// latency histogram. They run past the Prometheus defaults as box downloads
+// can take minutes.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// Metrics holds the counters served on /metrics in the Prometheus text
+// format. Labels only ever hold names that are in the catalog or route names,
+// so the number of series stays bounded whatever requests are made.
+type Metrics struct {
+	downloads      map[boxSeries]float64
+	downloadBytes  map[boxSeries]float64
+	queries        map[boxSeries]float64
+	checks         map[boxSeries]float64
+	homepageVisits float64
+	rejectedHosts  float64
+	requests       map[string]*histogram
+	mutex          sync.Mutex
+}
+
+// boxSeries is a series of a per box counter. The box is kept apart from the
+// labels so that boxes which are private, or no longer in the catalog, can be
+// left out when the metrics are written.
+type boxSeries struct {
+	User   string
+	Box    string
+	Labels string
+}
+
+type histogram struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     float64
+}
+
+var metrics Metrics
+
+// Downloaded counts a download of a catalogued box and the bytes sent for it.
+func (m *Metrics) Downloaded(user string, box string, version string, provider string, architecture string, written int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.downloads == nil {
+		m.downloads = make(map[boxSeries]float64)
+		m.downloadBytes = make(map[boxSeries]float64)
+	}
+	key := boxSeries{user, box, metricLabels("user", user, "box", box, "version", version, "provider", provider, "architecture", architecture)}
+	m.downloads[key]++
+	m.downloadBytes[key] += float64(written)
+}
+
+// Queried counts a metadata request for a catalogued box.
+func (m *Metrics) Queried(user string, box string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queries == nil {
+		m.queries = make(map[boxSeries]float64)
+	}
+	m.queries[boxSeries{user, box, metricLabels("user", user, "box", box)}]++
+}
+
+// Checked counts a HEAD request for a catalogued box.
+func (m *Metrics) Checked(user string, box string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.checks == nil {
+		m.checks = make(map[boxSeries]float64)
+	}
+	m.checks[boxSeries{user, box, metricLabels("user", user, "box", box)}]++
+}
+
+// Visited counts a homepage visit.
+func (m *Metrics) Visited() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.homepageVisits++
+}
+
+// RejectedHost counts a request made for a host that is not allowed.
+func (m *Metrics) RejectedHost() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rejectedHosts++
+}
+
+// Observe records how long a request to a route took.
+func (m *Metrics) Observe(route string, method string, status int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[string]*histogram)
+	}
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS":
+	default:
+		method = "other"
+	}
+	key := metricLabels("route", route, "method", method, "code", strconv.Itoa(status))
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{Buckets: make([]uint64, len(requestDurationBuckets))}
+		m.requests[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			h.Buckets[i]++
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+// Write renders every metric, along with gauges for the current catalog.
+func (m *Metrics) Write(buf *bytes.Buffer, catalog *Catalog) {
+	boxes, versions, size := 0, 0, int64(0)
+	for _, userBoxes := range catalog.Boxes {
+		for _, box := range userBoxes {
+			boxes++
+			versions += len(box.Versions)
+			for _, version := range box.Versions {
+				for _, provider := range version.Providers {
+					size += provider.Object.Size
+				}
+			}
+		}
+	}
+	writeMetric(buf, "vagrantshadow_catalog_boxes", "gauge", "Boxes in the catalog.", map[string]float64{"": float64(boxes)})
+	writeMetric(buf, "vagrantshadow_catalog_versions", "gauge", "Box versions in the catalog.", map[string]float64{"": float64(versions)})
+	writeMetric(buf, "vagrantshadow_catalog_bytes", "gauge", "Size of the box files in the catalog.", map[string]float64{"": float64(size)})
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeMetric(buf, "vagrantshadow_box_downloads_total", "counter", "Box downloads.", publicSeries(m.downloads, catalog))
+	writeMetric(buf, "vagrantshadow_box_download_bytes_total", "counter", "Bytes sent for box downloads.", publicSeries(m.downloadBytes, catalog))
+	writeMetric(buf, "vagrantshadow_box_queries_total", "counter", "Box metadata requests.", publicSeries(m.queries, catalog))
+	writeMetric(buf, "vagrantshadow_box_checks_total", "counter", "Box HEAD requests.", publicSeries(m.checks, catalog))
+	writeMetric(buf, "vagrantshadow_homepage_visits_total", "counter", "Homepage visits.", map[string]float64{"": m.homepageVisits})
+	writeMetric(buf, "vagrantshadow_rejected_hosts_total", "counter", "Requests made for hosts that are not allowed.", map[string]float64{"": m.rejectedHosts})
+
+	name := "vagrantshadow_http_request_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Time taken to answer requests, by route.\n# TYPE %s histogram\n", name, name)
+	keys := []string{}
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := m.requests[key]
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, formatMetricValue(bound), h.Buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.Count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, key, formatMetricValue(h.Sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, key, h.Count)
+	}
+}
+
+// publicSeries keeps the series of boxes that are in the catalog and public,
+// as /metrics is served to anyone and must not give away private box names.
+func publicSeries(series map[boxSeries]float64, catalog *Catalog) map[string]float64 {
+	public := make(map[string]float64)
+	for key, value := range series {
+		if box, ok := catalog.Boxes[key.User][key.Box]; ok && !box.Private {
+			public[key.Labels] = value
+		}
+	}
+	return public
+}
+
+func writeMetric(buf *bytes.Buffer, name string, kind string, help string, series map[string]float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, key := range sortedKeys(series) {
+		if key == "" {
+			fmt.Fprintf(buf, "%s %s\n", name, formatMetricValue(series[key]))
+		} else {
+			fmt.Fprintf(buf, "%s{%s} %s\n", name, key, formatMetricValue(series[key]))
+		}
+	}
+}
+
+func sortedKeys(series map[string]float64) []string {
+	keys := []string{}
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricLabels renders name, value pairs as a Prometheus label set.
+func metricLabels(pairs ...string) string {
+	labels := []string{}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+escaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(labels, ",")
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// responseRecorder remembers the status code and number of bytes written
+// through a ResponseWriter.
+type responseRecorder struct {
+	http.ResponseWriter
+	Status  int
+	Written int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.Status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.Status == 0 {
+		rr.Status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.Written += int64(n)
+	return n, err
+}
+
+// instrumentRoutes times every request to the router, labelling it with the
+// name of the route that answered it.
+func instrumentRoutes(m *mux.Router) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		route := "not_found"
+		var match mux.RouteMatch
+		if m.Match(r, &match) && match.Route.GetName() != "" {
+			route = match.Route.GetName()
+		}
+		start := time.Now()
+		rr := &responseRecorder{ResponseWriter: w}
+		m.ServeHTTP(rr, r)
+		if rr.Status == 0 {
+			rr.Status = http.StatusOK
+		}
+		metrics.Observe(route, r.Method, rr.Status, time.Since(start))
+	}
+	return http.HandlerFunc(fn)
+}
+
+func metricsHandler(bh *BoxHandler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		metrics.Write(&buf, bh.Catalog())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestMetricsAreLabelledByBoxAndRoute(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-metrics")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "metrics-VAGRANTSLASH-dev__1.0__virtualbox__amd64.box"), []byte("box contents"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "metrics-VAGRANTSLASH-secret__1.0__virtualbox.box"), []byte("box contents"), 0644)
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, PrivateBoxes: []string{"metrics/secret"}}
+	bh.Tokens = &TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	token, _ := bh.Tokens.Add("metrics", false, "")
+
+	m := mux.NewRouter()
+	m.Handle("/metrics", metricsHandler(bh)).Methods("GET").Name("metrics")
+	m.Handle("/{user}/{boxname}", getBox(bh, host)).Methods("GET").Name("box")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET").Name("download")
+	m.NotFoundHandler = http.HandlerFunc(notFound)
+	h := instrumentRoutes(m)
+
+	doRequest(h, "GET", "/metrics/dev", "")
+	doRequest(h, "GET", "/metrics/unknown", "")
+	doRequest(h, "GET", "/metrics/dev/1.0/virtualbox/virtualbox.box", "")
+	req, _ := http.NewRequest("GET", "/metrics/dev/1.0/virtualbox/virtualbox.box", nil)
+	req.Header.Set("Range", "bytes=0-2")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	doRequest(h, "GET", "/no/such/route/at/all/here", "")
+	assert.Equal(http.StatusOK, doRequest(h, "GET", "/metrics/secret?access_token="+token, "").Code)
+	assert.Equal(http.StatusOK, doRequest(h, "GET", "/metrics/secret/1.0/virtualbox/virtualbox.box?access_token="+token, "").Code)
+
+	body := doRequest(h, "GET", "/metrics", "").Body.String()
+	assert.Contains(body, `vagrantshadow_box_downloads_total{user="metrics",box="dev",version="1.0",provider="virtualbox",architecture="amd64"} 2`)
+	assert.Contains(body, `vagrantshadow_box_download_bytes_total{user="metrics",box="dev",version="1.0",provider="virtualbox",architecture="amd64"} 15`)
+	assert.Contains(body, `vagrantshadow_box_queries_total{user="metrics",box="dev"} 1`)
+	assert.NotContains(body, `box="unknown"`)
+	assert.NotContains(body, `box="secret"`)
+	assert.Contains(body, `vagrantshadow_http_request_duration_seconds_count{route="download",method="GET",code="206"} 1`)
+	assert.Contains(body, `vagrantshadow_http_request_duration_seconds_count{route="not_found",method="GET",code="404"} 1`)
+	assert.Contains(body, "vagrantshadow_catalog_boxes 2\n")
+	assert.Contains(body, "vagrantshadow_catalog_bytes 24\n")
+}
+
+func TestMetricLabelsAreEscaped(t *testing.T) {
+	assert.Equal(t, `a="x\"y\\z\n"`, metricLabels("a", "x\"y\\z\n"))
+}
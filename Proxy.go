@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// parseExternalUrl checks a -base-url value, returning it without a trailing
+// slash.
+func parseExternalUrl(external string) (string, error) {
+	u, err := url.Parse(external)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("base URL must be an absolute http or https URL")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("base URL cannot have a query or fragment")
+	}
+	return strings.TrimSuffix(external, "/"), nil
+}
+
+// PathPrefix is the path the server is mounted under, such as /vagrant, taken
+// from ExternalUrl.
+func (bh *BoxHandler) PathPrefix() string {
+	if bh.ExternalUrl == "" {
+		return ""
+	}
+	u, err := url.Parse(bh.ExternalUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// parseTrustedProxies reads addresses and CIDR ranges of proxies whose
+// forwarding headers are believed.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// fromTrustedProxy reports whether a request came through one of the
+// TrustedProxies.
+func (bh *BoxHandler) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return bh.trustedProxy(host)
+}
+
+// trustedProxy reports whether an address is one of the TrustedProxies.
+func (bh *BoxHandler) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range bh.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp is the address a request came from. Behind trusted proxies it is
+// the nearest address in X-Forwarded-For, or failing that Forwarded, that is
+// not itself a trusted proxy.
+func (bh *BoxHandler) clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !bh.fromTrustedProxy(r) {
+		return host
+	}
+	chain := []string{}
+	for _, value := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(address))
+		}
+	}
+	if len(chain) == 0 {
+		for _, element := range strings.Split(r.Header.Get("Forwarded"), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.ToLower(parts[0]) == "for" {
+					chain = append(chain, strings.Trim(parts[1], `"`))
+				}
+			}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		address := chain[i]
+		if h, _, err := net.SplitHostPort(address); err == nil {
+			address = h
+		}
+		if address = strings.Trim(address, "[]"); address == "" {
+			break
+		}
+		host = address
+		if !bh.trustedProxy(address) {
+			break
+		}
+	}
+	return host
+}
+
+// requestBaseUrl is the address a client reached the server on. The Host
+// header and TLS state are used, along with the X-Forwarded-Proto,
+// X-Forwarded-Host, X-Forwarded-Prefix and Forwarded headers of trusted
+// proxies. Without a forwarded prefix the prefix of ExternalUrl is kept.
+func (bh *BoxHandler) requestBaseUrl(r *http.Request) string {
+	scheme := requestScheme(r)
+	host := r.Host
+	prefix := bh.PathPrefix()
+	if bh.fromTrustedProxy(r) {
+		if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+			// Only the element added by the nearest proxy is used.
+			elements := strings.Split(forwarded, ",")
+			for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				value := strings.Trim(parts[1], `"`)
+				switch strings.ToLower(parts[0]) {
+				case "proto":
+					scheme = strings.ToLower(value)
+				case "host":
+					host = value
+				}
+			}
+		}
+		if proto := lastHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+			scheme = strings.ToLower(proto)
+		}
+		if forwardedHost := lastHeaderValue(r, "X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+		if forwardedPrefix := lastHeaderValue(r, "X-Forwarded-Prefix"); forwardedPrefix != "" {
+			prefix = "/" + strings.Trim(forwardedPrefix, "/")
+		}
+	}
+	if scheme != "https" {
+		scheme = "http"
+	}
+	return scheme + "://" + host + prefix
+}
+
+// allowedHost reports whether URLs may be built for a host, which is matched,
+// with or without its port, against AllowedHosts. Only Hostname, and the
+// host of ExternalUrl, are allowed when none are configured.
+func (bh *BoxHandler) allowedHost(host string) bool {
+	patterns := bh.AllowedHosts
+	if len(patterns) == 0 {
+		patterns = []string{bh.Hostname}
+		if u, err := url.Parse(bh.ExternalUrl); err == nil && u.Host != "" {
+			patterns = append(patterns, u.Host)
+		}
+	}
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if matched, _ := path.Match(pattern, hostname); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// lastHeaderValue returns the value added by the nearest proxy to a header
+// that proxies append to with commas.
+func lastHeaderValue(r *http.Request, name string) string {
+	values := strings.Split(r.Header.Get(name), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+// responseBaseUrl is the base URL for the URLs in a response to r, which is
+// BaseUrl unless RequestHost is set. Then it is the address the request was
+// made to if its host is allowed, and otherwise BaseUrl or, with
+// RejectUnknownHosts, an error sent in answer and false returned.
+func (bh *BoxHandler) responseBaseUrl(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !bh.RequestHost {
+		return bh.BaseUrl(), true
+	}
+	base := bh.requestBaseUrl(r)
+	if host := strings.SplitN(base, "/", 4)[2]; !bh.allowedHost(host) {
+		rejectedHosts.Add(1)
+		metrics.RejectedHost()
+		if bh.RejectUnknownHosts {
+			logger.Warn("Rejected request for unknown host", "host", host)
+			writeJsonError(w, http.StatusBadRequest, "Unknown host")
+			return "", false
+		}
+		logger.Warn("Ignoring unknown host", "host", host)
+		return bh.BaseUrl(), true
+	}
+	return base, true
+}
+
+// rebaseUrl points a URL below one base URL at another. URLs elsewhere,
+// such as those of proxied boxes, are left alone.
+func rebaseUrl(u *string, from string, to string) {
+	if strings.HasPrefix(*u, from+"/") {
+		*u = to + strings.TrimPrefix(*u, from)
+	}
+}
+
+// rebasedBox returns a copy of a box served from one base URL with its URLs
+// pointed at another. The box itself, which may be part of the catalog, is
+// left unchanged.
+func rebasedBox(box Box, from string, to string) Box {
+	if from == to {
+		return box
+	}
+	versions := make([]Version, len(box.Versions))
+	for i, v := range box.Versions {
+		versions[i] = rebasedVersion(v, from, to)
+	}
+	box.Versions = versions
+	box.CurrentVersion = currentVersion(box.Versions)
+	return box
+}
+
+func rebasedVersion(version Version, from string, to string) Version {
+	providers := make([]Provider, len(version.Providers))
+	for i, p := range version.Providers {
+		providers[i] = rebasedProvider(p, from, to)
+	}
+	version.Providers = providers
+	rebaseUrl(&version.ReleaseUrl, from, to)
+	rebaseUrl(&version.RevokeUrl, from, to)
+	return version
+}
+
+func rebasedProvider(provider Provider, from string, to string) Provider {
+	rebaseUrl(&provider.DownloadUrl, from, to)
+	rebaseUrl(&provider.Url, from, to)
+	rebaseUrl(&provider.UploadUrl, from, to)
+	return provider
+}
+
+// stripPathPrefix serves requests made below the path prefix as though they
+// were made to the root, for proxies that pass the prefix on. Requests
+// without it, from proxies that strip the prefix, are served unchanged.
+func stripPathPrefix(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			stripped := *r.URL
+			stripped.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			if stripped.Path == "" {
+				stripped.Path = "/"
+			}
+			stripped.RawPath = ""
+			r2 := *r
+			r2.URL = &stripped
+			h.ServeHTTP(w, &r2)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
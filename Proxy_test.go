@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func doProxiedRequest(h http.Handler, url string, remote string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "internal:8099"
+	req.RemoteAddr = remote
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestForwardedHeadersAreOnlyBelievedFromTrustedProxies(t *testing.T) {
+	assert := assert.New(t)
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	assert.Nil(err)
+	bh := &BoxHandler{TrustedProxies: proxies}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "boxes.example.com", "X-Forwarded-Prefix": "/vagrant/"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "internal:8099"
+	req.RemoteAddr = "203.0.113.9:1234"
+	for name, value := range forwarded {
+		req.Header.Set(name, value)
+	}
+	assert.Equal("http://internal:8099", bh.requestBaseUrl(req))
+	req.RemoteAddr = "10.1.2.3:1234"
+	assert.Equal("https://boxes.example.com/vagrant", bh.requestBaseUrl(req))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Host = "internal:8099"
+	req.RemoteAddr = "192.168.1.5:1234"
+	req.Header.Set("Forwarded", `for=198.51.100.1;proto=http;host=spoofed, for=203.0.113.9;proto=https;host="boxes.example.com:8443"`)
+	assert.Equal("https://boxes.example.com:8443", bh.requestBaseUrl(req))
+
+	_, err = parseTrustedProxies([]string{"not an address"})
+	assert.NotNil(err)
+}
+
+func TestRoutesAndUrlsHonourThePathPrefix(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	external, err := parseExternalUrl("https://boxes.example.com/vagrant/")
+	assert.Nil(err)
+	bh.ExternalUrl = external
+	bh.TrustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1"})
+	bh.AllowedHosts = []string{"internal", "*.example.com"}
+	bh.PopulateBoxes([]string{dir}, &bh.Port, &bh.Hostname)
+	assert.Equal("/vagrant", bh.PathPrefix())
+
+	bh.RequestHost = true
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, bh.Hostname)).Methods("GET")
+	h := stripPathPrefix(bh.PathPrefix(), m)
+
+	var box Box
+	w := doProxiedRequest(h, "/vagrant/benphegan/dev", "203.0.113.9:1234", nil)
+	assert.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &box)
+	assert.Equal("http://internal:8099/vagrant/benphegan/dev/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+
+	w = doProxiedRequest(h, "/benphegan/dev", "127.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "mirror.example.com"})
+	assert.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &box)
+	assert.Equal("https://mirror.example.com/vagrant/benphegan/dev/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+	assert.Equal("https://mirror.example.com/vagrant/api/v1/box/benphegan/dev/version/1.0/release", box.CurrentVersion.ReleaseUrl)
+
+	assert.Equal("https://boxes.example.com/vagrant/benphegan/dev/1.0/virtualbox/virtualbox.box", bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0].DownloadUrl)
+
+	_, err = parseExternalUrl("boxes.example.com/vagrant")
+	assert.NotNil(err)
+}
+
+func TestOnlyAllowedHostsAreUsedForUrls(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	bh.RequestHost = true
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, bh.Hostname)).Methods("GET")
+	rejected := rejectedHosts.Value()
+
+	var box Box
+	w := doProxiedRequest(m, "/benphegan/dev", "203.0.113.9:1234", nil)
+	json.Unmarshal(w.Body.Bytes(), &box)
+	assert.Equal("http://localhost:8099/benphegan/dev/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+	assert.Equal(rejected+1, rejectedHosts.Value())
+
+	bh.AllowedHosts = []string{"*.example.com", "internal:8099"}
+	assert.True(bh.allowedHost("boxes.EXAMPLE.com:8443"))
+	assert.True(bh.allowedHost("internal:8099"))
+	assert.False(bh.allowedHost("internal:8100"))
+	assert.False(bh.allowedHost("example.com.attacker.net"))
+	w = doProxiedRequest(m, "/benphegan/dev", "203.0.113.9:1234", nil)
+	json.Unmarshal(w.Body.Bytes(), &box)
+	assert.Equal("http://internal:8099/benphegan/dev/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+
+	bh.AllowedHosts = []string{"boxes.example.com"}
+	bh.RejectUnknownHosts = true
+	w = doProxiedRequest(m, "/benphegan/dev", "203.0.113.9:1234", nil)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(rejected+2, rejectedHosts.Value())
+}
+
+func TestApiAndSearchUrlsAreBuiltForTheRequest(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	bh := p.BoxHandler
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("one"), 0644)
+	p.Refresh()
+	doRequest(m, "POST", "/api/v1/box/benphegan/dev/versions", `{"version": {"version": "2.0"}}`)
+	doRequest(m, "POST", "/api/v1/box/benphegan/dev/version/2.0/providers", `{"provider": {"name": "virtualbox"}}`)
+	m.Handle("/api/v1/search", searchHandler(bh)).Methods("GET")
+	bh.RequestHost = true
+	bh.TrustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1"})
+	bh.AllowedHosts = []string{"*.example.com"}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "boxes.example.com", "X-Forwarded-Prefix": "/vagrant"}
+	base := "https://boxes.example.com/vagrant"
+
+	var search struct{ Boxes []Box }
+	w := doProxiedRequest(m, "/api/v1/search?q=dev", "127.0.0.1:1234", forwarded)
+	json.Unmarshal(w.Body.Bytes(), &search)
+	assert.Equal(1, len(search.Boxes))
+	assert.Equal(base+"/benphegan/dev/1.0/virtualbox/virtualbox.box", search.Boxes[0].CurrentVersion.Providers[0].Url)
+
+	var box Box
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/box/benphegan/dev", "127.0.0.1:1234", forwarded).Body.Bytes(), &box)
+	assert.Equal(base+"/benphegan/dev/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].DownloadUrl)
+	assert.Equal(base+"/api/v1/box/benphegan/dev/version/2.0/release", box.Versions[0].ReleaseUrl)
+
+	var version Version
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/box/benphegan/dev/version/1.0", "127.0.0.1:1234", forwarded).Body.Bytes(), &version)
+	assert.Equal(base+"/benphegan/dev/1.0/virtualbox/virtualbox.box", version.Providers[0].Url)
+
+	var provider Provider
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/box/benphegan/dev/version/2.0/provider/virtualbox", "127.0.0.1:1234", forwarded).Body.Bytes(), &provider)
+	assert.Equal(base+"/api/v1/box/benphegan/dev/version/2.0/provider/virtualbox/upload", provider.UploadUrl)
+
+	var upload map[string]string
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/box/benphegan/dev/version/2.0/provider/virtualbox/upload", "127.0.0.1:1234", forwarded).Body.Bytes(), &upload)
+	assert.Equal(base+"/api/v1/upload/"+upload["token"], upload["upload_path"])
+
+	var profile UserProfile
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/user/benphegan", "127.0.0.1:1234", forwarded).Body.Bytes(), &profile)
+	assert.Equal(base+"/benphegan/dev/1.0/virtualbox/virtualbox.box", profile.Boxes[0].CurrentVersion.Providers[0].Url)
+
+	// Requests that are not forwarded, and the catalog itself, keep -h.
+	json.Unmarshal(doProxiedRequest(m, "/api/v1/search?q=dev", "203.0.113.9:1234", forwarded).Body.Bytes(), &search)
+	assert.Equal("http://localhost:8099/benphegan/dev/1.0/virtualbox/virtualbox.box", search.Boxes[0].CurrentVersion.Providers[0].Url)
+	assert.Equal("http://localhost:8099/benphegan/dev/1.0/virtualbox/virtualbox.box", bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0].Url)
+
+	home := &HomePageTemplate{BoxHandler: bh}
+	home.TemplateString = home.GetDefaultTemplateString()
+	w = doProxiedRequest(showHomepage(home), "/", "127.0.0.1:1234", forwarded)
+	assert.Contains(w.Body.String(), "VAGRANT_SERVER_URL="+base+"<")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy decides which versions of a box are kept. A version is
+// kept if any rule keeps it, and a rule of 0 keeps nothing, so with no rules
+// every version is kept. The current version and unreleased versions are
+// always kept.
+type RetentionPolicy struct {
+	KeepVersions       int
+	KeepDownloadedDays int
+}
+
+// Enabled reports whether the policy would remove anything.
+func (rp RetentionPolicy) Enabled() bool {
+	return rp.KeepVersions > 0 || rp.KeepDownloadedDays > 0
+}
+
+// For returns the policy for a box, with the overrides from its descriptor.
+func (rp RetentionPolicy) For(box Box) RetentionPolicy {
+	if box.Retention == nil {
+		return rp
+	}
+	if box.Retention.KeepVersions != nil {
+		rp.KeepVersions = *box.Retention.KeepVersions
+	}
+	if box.Retention.KeepDownloadedDays != nil {
+		rp.KeepDownloadedDays = *box.Retention.KeepDownloadedDays
+	}
+	return rp
+}
+
+// PruneVersion is a version whose files a policy would remove.
+type PruneVersion struct {
+	Username string
+	Boxname  string
+	Version  string
+	Reason   string
+	Files    []Provider
+}
+
+// Pruner removes the files of versions that the retention policy no longer
+// keeps, moving them into Trash or, if it is empty, deleting them. Each
+// directory's files go into a directory of their own in the trash. Boxes in
+// the upstream cache are left to the cache's own eviction.
+type Pruner struct {
+	BoxHandler *BoxHandler
+	Policy     RetentionPolicy
+	Trash      string
+	Refresh    func()
+}
+
+// Plan works out what the policy would remove from the current catalog.
+func (p *Pruner) Plan() []PruneVersion {
+	plan := []PruneVersion{}
+	boxes := p.BoxHandler.Boxes()
+	for _, user := range sortedBoxKeys(boxes) {
+		names := []string{}
+		for name := range boxes[user] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			plan = append(plan, p.planBox(user, name, boxes[user][name])...)
+		}
+	}
+	return plan
+}
+
+func (p *Pruner) planBox(user string, name string, box Box) []PruneVersion {
+	policy := p.Policy.For(box)
+	if !policy.Enabled() {
+		return nil
+	}
+	since := time.Now().AddDate(0, 0, -policy.KeepDownloadedDays)
+	plan := []PruneVersion{}
+	newest := 0
+	// Versions are sorted newest first.
+	for _, v := range box.Versions {
+		files := []Provider{}
+		for _, provider := range v.Providers {
+			if provider.Storage != nil && !p.BoxHandler.Upstream.Cached(provider) {
+				files = append(files, provider)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+		newest++
+		if box.CurrentVersion != nil && v.Version == box.CurrentVersion.Version || v.Status == VersionUnreleased {
+			continue
+		}
+		if policy.KeepVersions > 0 && newest <= policy.KeepVersions {
+			continue
+		}
+		if policy.KeepDownloadedDays > 0 && p.BoxHandler.Stats.LastDownloaded(user, name, v.Version).After(since) {
+			continue
+		}
+		reasons := []string{}
+		if policy.KeepVersions > 0 {
+			reasons = append(reasons, "not one of the newest "+strconv.Itoa(policy.KeepVersions)+" versions")
+		}
+		if policy.KeepDownloadedDays > 0 {
+			reasons = append(reasons, "not downloaded in the last "+strconv.Itoa(policy.KeepDownloadedDays)+" days")
+		}
+		plan = append(plan, PruneVersion{Username: user, Boxname: name, Version: v.Version, Reason: strings.Join(reasons, ", "), Files: files})
+	}
+	return plan
+}
+
+func sortedBoxKeys(boxes map[string]map[string]Box) []string {
+	keys := []string{}
+	for key := range boxes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// remove moves a box file into the trash directory, or deletes it.
+func (p *Pruner) remove(file Provider) error {
+	key := file.Object.Key
+	if p.Trash == "" {
+		return file.Storage.Delete(key)
+	}
+	target := filepath.Join(p.Trash, trashName(file.Storage), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fs, ok := file.Storage.(*FileStorage); ok {
+		// Renaming fails across file systems, where it is copied instead.
+		if err := os.Rename(fs.Location(key), target); err == nil {
+			return nil
+		}
+	}
+	in, err := file.Storage.OpenRange(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+	return file.Storage.Delete(key)
+}
+
+// trashName names the directory of the trash that files from a storage are
+// moved into, such as boxes-9c9fca9a for /srv/boxes, so that files of the
+// same name from different directories are kept apart.
+func trashName(s Storage) string {
+	root := strings.TrimRight(s.Location(""), "/"+string(filepath.Separator))
+	sum := sha1.Sum([]byte(root))
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, path.Base(filepath.ToSlash(root)))
+	return strings.TrimLeft(name, ".") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Prune removes every version in the plan, or with dryRun only reports
+// them, and returns the number of files that could not be removed.
+func (p *Pruner) Prune(dryRun bool) int {
+	plan := p.Plan()
+	failed := 0
+	for _, v := range plan {
+		name := v.Username + "/" + v.Boxname + "/" + v.Version
+		if dryRun {
+			fmt.Println("Would remove " + name + " (" + v.Reason + ")")
+			for _, file := range v.Files {
+				fmt.Println("\t" + file.LocalBoxFile)
+			}
+			continue
+		}
+		logger.Info("Pruning version", "version", name, "reason", v.Reason)
+		removed := true
+		for _, file := range v.Files {
+			if err := p.remove(file); err != nil && err != ErrStorageObjectNotFound {
+				logger.Error("Could not remove box file", "file", file.LocalBoxFile, "error", err)
+				failed++
+				removed = false
+			}
+		}
+		if removed && p.BoxHandler.Publisher != nil {
+			if err := p.BoxHandler.Publisher.ForgetVersion(v.Username, v.Boxname, v.Version); err != nil {
+				logger.Error("Could not update publish records", "version", name, "error", err)
+			}
+		}
+	}
+	if dryRun {
+		fmt.Println(strconv.Itoa(len(plan)) + " versions would be removed")
+	} else if len(plan) > 0 && p.Refresh != nil {
+		p.Refresh()
+	}
+	return failed
+}
+
+// Schedule prunes every interval.
+func (p *Pruner) Schedule(interval time.Duration) {
+	for {
+		p.Prune(false)
+		time.Sleep(interval)
+	}
+}
+
+// pruneCommand implements `vagrantshadow prune [-n]`.
+func pruneCommand(p *Pruner, args []string) int {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "-n" && arg != "-dry-run" {
+			logger.Error("Usage: vagrantshadow [-keep-versions N] [-keep-downloaded-days N] [-trash directory] prune [-n]")
+			return 2
+		}
+		dryRun = true
+	}
+	if p.Prune(dryRun) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestPruneFollowsRetentionRules(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-prune")
+	defer os.RemoveAll(dir)
+	trash, _ := ioutil.TempDir("", "vagrantshadow-trash")
+	defer os.RemoveAll(trash)
+	for _, box := range []string{"dev", "pinned", "custom"} {
+		for _, v := range []string{"1.0", "2.0", "3.0", "4.0", "5.0"} {
+			ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-"+box+"__"+v+"__virtualbox.box"), []byte(v), 0644)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-pinned.yaml"), []byte("retention:\n  keep_versions: 0\n  keep_downloaded_days: 0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-custom.yaml"), []byte("retention:\n  keep_versions: 4\n"), 0644)
+
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, Stats: &DownloadStats{}}
+	bh.Stats.Record("benphegan", "dev", "2.0")
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	p := &Pruner{
+		BoxHandler: bh,
+		Policy:     RetentionPolicy{KeepVersions: 2, KeepDownloadedDays: 30},
+		Trash:      trash,
+		Refresh:    func() { bh.PopulateBoxes([]string{dir}, &port, &host) },
+	}
+
+	planned := []string{}
+	for _, v := range p.Plan() {
+		planned = append(planned, v.Username+"/"+v.Boxname+"/"+v.Version)
+	}
+	assert.Equal([]string{"benphegan/custom/1.0", "benphegan/dev/3.0", "benphegan/dev/1.0"}, planned)
+
+	assert.Equal(0, p.Prune(true))
+	assert.Equal(5, len(bh.GetBox("benphegan", "dev").Versions))
+
+	assert.Equal(0, p.Prune(false))
+	versions := []string{}
+	for _, v := range bh.GetBox("benphegan", "dev").Versions {
+		versions = append(versions, v.Version)
+	}
+	assert.Equal([]string{"5.0", "4.0", "2.0"}, versions)
+	assert.Equal(4, len(bh.GetBox("benphegan", "custom").Versions))
+	assert.Equal(5, len(bh.GetBox("benphegan", "pinned").Versions))
+	contents, err := ioutil.ReadFile(filepath.Join(trash, trashName(&FileStorage{Root: dir}), "benphegan-VAGRANTSLASH-dev__3.0__virtualbox.box"))
+	assert.Nil(err)
+	assert.Equal("3.0", string(contents))
+
+	p.Trash = ""
+	p.Policy = RetentionPolicy{KeepVersions: 1}
+	assert.Equal(0, p.Prune(false))
+	assert.Equal(1, len(bh.GetBox("benphegan", "dev").Versions))
+	assert.Equal("5.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+	_, err = os.Stat(filepath.Join(trash, trashName(&FileStorage{Root: dir}), "benphegan-VAGRANTSLASH-dev__4.0__virtualbox.box"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestPruneKeepsDirectoriesApartAndLeavesTheUpstreamCache(t *testing.T) {
+	assert := assert.New(t)
+	first, _ := ioutil.TempDir("", "vagrantshadow-prune")
+	defer os.RemoveAll(first)
+	second, _ := ioutil.TempDir("", "vagrantshadow-prune")
+	defer os.RemoveAll(second)
+	cache, _ := ioutil.TempDir("", "vagrantshadow-upstream")
+	defer os.RemoveAll(cache)
+	trash, _ := ioutil.TempDir("", "vagrantshadow-trash")
+	defer os.RemoveAll(trash)
+	ioutil.WriteFile(filepath.Join(first, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("first"), 0644)
+	ioutil.WriteFile(filepath.Join(first, "benphegan-VAGRANTSLASH-dev__3.0__virtualbox.box"), []byte("3.0"), 0644)
+	ioutil.WriteFile(filepath.Join(second, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("second"), 0644)
+	ioutil.WriteFile(filepath.Join(cache, "acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box"), []byte("1.0"), 0644)
+	ioutil.WriteFile(filepath.Join(cache, "acme-VAGRANTSLASH-ubuntu__2.0__virtualbox.box"), []byte("2.0"), 0644)
+
+	host := "localhost"
+	port := 8099
+	directories := []string{first, second, cache}
+	bh := &BoxHandler{Hostname: host, Port: port}
+	bh.Upstream = &Upstream{Directory: cache, BoxHandler: bh}
+	bh.PopulateBoxes(directories, &port, &host)
+	p := &Pruner{
+		BoxHandler: bh,
+		Policy:     RetentionPolicy{KeepVersions: 1},
+		Trash:      trash,
+		Refresh:    func() { bh.PopulateBoxes(directories, &port, &host) },
+	}
+	assert.Equal(0, p.Prune(false))
+	assert.Equal(1, len(bh.GetBox("benphegan", "dev").Versions))
+	assert.Equal(2, len(bh.GetBox("acme", "ubuntu").Versions))
+
+	firstName := trashName(&FileStorage{Root: first})
+	secondName := trashName(&FileStorage{Root: second})
+	assert.NotEqual(firstName, secondName)
+	contents, _ := ioutil.ReadFile(filepath.Join(trash, firstName, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"))
+	assert.Equal("first", string(contents))
+	contents, _ = ioutil.ReadFile(filepath.Join(trash, secondName, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"))
+	assert.Equal("second", string(contents))
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// publishRecordFile is the name of the file, kept in the publish directory,
+// that remembers boxes, versions and providers created through the API.
+const publishRecordFile = ".vagrantshadow-publish.json"
+
+// Publisher implements the box/version/provider/upload/release endpoints of
+// the Vagrant Cloud API that Packer's vagrant-cloud post-processor and
+// `vagrant cloud publish` use. Uploaded boxes are written into Directory
+// using the normal catalog naming scheme so the indexer serves them.
+type Publisher struct {
+	BoxHandler *BoxHandler
+	Directory  string
+	Refresh    func()
+	Records    map[string]*PublishedBox
+	uploads    map[string]PendingUpload
+	loaded     time.Time
+	mutex      sync.Mutex
+}
+
+// ErrVersionNotFound is returned when changing the state of a version that
+// has neither been published nor found on disk.
+var ErrVersionNotFound = errors.New("version not found")
+
+// ErrVersionHasNoProviders is returned when releasing a version that has
+// nothing to download.
+var ErrVersionHasNoProviders = errors.New("version has no providers")
+
+type PublishedBox struct {
+	Username         string                       `json:"username"`
+	Name             string                       `json:"name"`
+	ShortDescription string                       `json:"short_description"`
+	Description      string                       `json:"description"`
+	Private          bool                         `json:"is_private"`
+	Created          string                       `json:"created_at"`
+	Updated          string                       `json:"updated_at"`
+	Versions         map[string]*PublishedVersion `json:"versions"`
+}
+
+type PublishedVersion struct {
+	Version     string                        `json:"version"`
+	Description string                        `json:"description"`
+	Status      string                        `json:"status"`
+	Created     string                        `json:"created_at"`
+	Updated     string                        `json:"updated_at"`
+	Providers   map[string]*PublishedProvider `json:"providers"`
+}
+
+type PublishedProvider struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture,omitempty"`
+	Url          string `json:"url"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+	HostedToken  string `json:"hosted_token"`
+	Created      string `json:"created_at"`
+	Updated      string `json:"updated_at"`
+}
+
+// PendingUpload remembers which provider an upload token was issued for.
+type PendingUpload struct {
+	Username     string
+	Boxname      string
+	Version      string
+	Provider     string
+	Architecture string
+}
+
+type boxRequest struct {
+	Box struct {
+		Username         string `json:"username"`
+		Name             string `json:"name"`
+		ShortDescription string `json:"short_description"`
+		Description      string `json:"description"`
+		Private          *bool  `json:"is_private"`
+	} `json:"box"`
+}
+
+type versionRequest struct {
+	Version struct {
+		Version     string `json:"version"`
+		Description string `json:"description"`
+	} `json:"version"`
+}
+
+type providerRequest struct {
+	Provider struct {
+		Name         string `json:"name"`
+		Architecture string `json:"architecture"`
+		Url          string `json:"url"`
+		Checksum     string `json:"checksum"`
+		ChecksumType string `json:"checksum_type"`
+	} `json:"provider"`
+}
+
+func publishTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func newUploadToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Load reads previously published records from the publish directory.
+func (p *Publisher) Load() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.uploads = make(map[string]PendingUpload)
+	p.load()
+}
+
+// load must be called with the mutex held.
+func (p *Publisher) load() {
+	p.Records = make(map[string]*PublishedBox)
+	p.loaded = time.Time{}
+	object, err := p.storage().Stat(publishRecordFile)
+	if err != nil {
+		return
+	}
+	data, err := readStorageObject(p.storage(), publishRecordFile)
+	if err != nil {
+		return
+	}
+	p.loaded = object.ModTime
+	if err := json.Unmarshal(data, &p.Records); err != nil {
+		logger.Warn("Could not read publish records", "error", err)
+		p.Records = make(map[string]*PublishedBox)
+	}
+}
+
+// reload picks up changes made to the records by another process, such as
+// the `vagrantshadow version` command. Must be called with the mutex held.
+func (p *Publisher) reload() {
+	object, err := p.storage().Stat(publishRecordFile)
+	if err == nil && !object.ModTime.Equal(p.loaded) {
+		logger.Info("Publish records changed, reloading")
+		p.load()
+	}
+}
+
+// save must be called with the mutex held.
+func (p *Publisher) save() error {
+	data, err := json.MarshalIndent(p.Records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := p.storage().Put(publishRecordFile, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	if object, err := p.storage().Stat(publishRecordFile); err == nil {
+		p.loaded = object.ModTime
+	}
+	return nil
+}
+
+func (p *Publisher) storage() Storage {
+	return p.BoxHandler.StorageFor(p.Directory)
+}
+
+func (p *Publisher) refresh() {
+	if p.Refresh != nil {
+		p.Refresh()
+	}
+}
+
+// record returns the publish record for a box, creating one when the box
+// only exists as files on disk. Must be called with the mutex held.
+func (p *Publisher) record(username string, boxName string) *PublishedBox {
+	p.reload()
+	key := username + "/" + boxName
+	record := p.Records[key]
+	if record == nil {
+		now := publishTimestamp()
+		record = &PublishedBox{Username: username, Name: boxName, Created: now, Updated: now, Versions: make(map[string]*PublishedVersion)}
+		p.Records[key] = record
+	}
+	return record
+}
+
+// providerRecordKey is the key of a provider in the records of its version.
+// Architectures of the same provider are kept apart.
+func providerRecordKey(provider string, architecture string) string {
+	if architecture == "" {
+		return provider
+	}
+	return provider + "__" + architecture
+}
+
+func (p *Publisher) versionRecord(record *PublishedBox, version string) *PublishedVersion {
+	v := record.Versions[version]
+	if v == nil {
+		now := publishTimestamp()
+		v = &PublishedVersion{Version: version, Status: VersionActive, Created: now, Updated: now, Providers: make(map[string]*PublishedProvider)}
+		record.Versions[version] = v
+	}
+	return v
+}
+
+// known reports whether a box exists either on disk or in the publish records.
+// Must be called with the mutex held.
+func (p *Publisher) known(username string, boxName string) bool {
+	return p.Records[username+"/"+boxName] != nil || p.BoxHandler.BoxAvailable(username, boxName)
+}
+
+// knownVersion reports whether a version has been created through the API or
+// exists on disk. Must be called with the mutex held.
+func (p *Publisher) knownVersion(username string, boxName string, version string) bool {
+	if record := p.Records[username+"/"+boxName]; record != nil && record.Versions[version] != nil {
+		return true
+	}
+	for _, v := range p.BoxHandler.GetBox(username, boxName).Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Decorate merges the publish records into a freshly built catalog, adding
+// boxes and versions that have been created but not uploaded yet.
+func (p *Publisher) Decorate(boxes map[string]map[string]Box) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reload()
+	for _, record := range p.Records {
+		if boxes[record.Username] == nil {
+			boxes[record.Username] = make(map[string]Box)
+		}
+		box := boxes[record.Username][record.Name]
+		if box.Name == "" {
+			box.Name = record.Username + "/" + record.Name
+			box.Username = record.Username
+		}
+		box.Tag = box.Name
+		box.ShortDescription = record.ShortDescription
+		box.DescriptionMarkdown = record.Description
+		box.Private = record.Private
+		box.Created = record.Created
+		box.Updated = record.Updated
+
+		for _, rv := range record.Versions {
+			index := -1
+			for i, v := range box.Versions {
+				if v.Version == rv.Version {
+					index = i
+				}
+			}
+			if index == -1 {
+				box.Versions = append(box.Versions, Version{
+					Version:    rv.Version,
+					ReleaseUrl: p.BoxHandler.apiUrl("box", record.Username, record.Name, "version", rv.Version, "release"),
+					RevokeUrl:  p.BoxHandler.apiUrl("box", record.Username, record.Name, "version", rv.Version, "revoke"),
+				})
+				index = len(box.Versions) - 1
+			}
+			version := &box.Versions[index]
+			version.Status = rv.Status
+			version.DescriptionMarkdown = rv.Description
+			version.Created = rv.Created
+			version.Updated = rv.Updated
+			for _, rp := range rv.Providers {
+				found := false
+				for j := range version.Providers {
+					if version.Providers[j].Name == rp.Name && version.Providers[j].Architecture == rp.Architecture {
+						version.Providers[j].HostedToken = rp.HostedToken
+						version.Providers[j].Created = rp.Created
+						version.Providers[j].Updated = rp.Updated
+						found = true
+					}
+				}
+				if !found && rp.Url != "" {
+					version.Providers = append(version.Providers, Provider{
+						Name:         rp.Name,
+						Architecture: rp.Architecture,
+						Hosted:       "false",
+						OriginalUrl:  rp.Url,
+						DownloadUrl:  rp.Url,
+						Url:          rp.Url,
+						Checksum:     rp.Checksum,
+						ChecksumType: rp.ChecksumType,
+						Created:      rp.Created,
+						Updated:      rp.Updated,
+					})
+				}
+			}
+		}
+		sortVersions(&box)
+		boxes[record.Username][record.Name] = box
+	}
+}
+
+// BoxKey returns where an upload for the given provider is stored, or false
+// if the names could not be served back.
+func (p *Publisher) BoxKey(username string, boxName string, version string, provider string, architecture string) (string, bool) {
+	return p.BoxHandler.BoxKey(p.Directory, username, boxName, version, provider, architecture)
+}
+
+func decodeJsonBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+}
+
+func createBoxHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var req boxRequest
+		if err := decodeJsonBody(r, &req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		username, boxName := req.Box.Username, req.Box.Name
+		if _, ok := p.BoxKey(username, boxName, "0", "virtualbox", ""); !ok {
+			writeJsonError(w, http.StatusUnprocessableEntity, "Invalid username or box name")
+			return
+		}
+		if !canPublish(p.BoxHandler, r, username) {
+			writeJsonError(w, http.StatusForbidden, "Token cannot publish boxes for "+username)
+			return
+		}
+
+		p.mutex.Lock()
+		if p.Records[username+"/"+boxName] != nil {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusUnprocessableEntity, "Box "+username+"/"+boxName+" already exists")
+			return
+		}
+		record := p.record(username, boxName)
+		record.ShortDescription = req.Box.ShortDescription
+		record.Description = req.Box.Description
+		if req.Box.Private != nil {
+			record.Private = *req.Box.Private
+		}
+		err := p.save()
+		p.mutex.Unlock()
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not save box")
+			return
+		}
+
+		logger.Info("Created box", "box", username+"/"+boxName)
+		p.refresh()
+		p.writeBox(w, r, p.BoxHandler.GetBox(username, boxName))
+	}
+	return http.HandlerFunc(fn)
+}
+
+func showBoxHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		box := p.BoxHandler.GetBox(vars["user"], vars["boxname"])
+		if box.Name == "" {
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		if !authorizeBox(p.BoxHandler, w, r, box) {
+			return
+		}
+		// Publishers see every version and its state, anyone else what
+		// Vagrant would be served.
+		if !canPublish(p.BoxHandler, r, box.Username) {
+			box = box.ServedVersions(false)
+		}
+		p.writeBox(w, r, box)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// showVersionHandler answers `vagrant cloud version` lookups. As with
+// showBoxHandler, versions that are not released are only shown to those who
+// can publish the box.
+func showVersionHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		box := p.BoxHandler.GetBox(vars["user"], vars["boxname"])
+		if !authorizeBox(p.BoxHandler, w, r, box) {
+			return
+		}
+		if !canPublish(p.BoxHandler, r, box.Username) {
+			box = box.ServedVersions(false)
+		}
+		p.writeVersionOf(w, r, box, vars["version"])
+	}
+	return http.HandlerFunc(fn)
+}
+
+// UserProfile is a user as the Vagrant Cloud API describes them.
+type UserProfile struct {
+	Username        string  `json:"username"`
+	AvatarUrl       *string `json:"avatar_url"`
+	ProfileHtml     string  `json:"profile_html"`
+	ProfileMarkdown string  `json:"profile_markdown"`
+	Boxes           []Box   `json:"boxes"`
+}
+
+// showUserHandler lists the boxes of a user that the caller can see.
+func showUserHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["user"]
+		access := hasAccess(p.BoxHandler, r, username)
+		names := []string{}
+		userBoxes := p.BoxHandler.Boxes()[username]
+		for name, box := range userBoxes {
+			if !box.Private || access {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		base, ok := p.BoxHandler.responseBaseUrl(w, r)
+		if !ok {
+			return
+		}
+		sort.Strings(names)
+		profile := UserProfile{Username: username, Boxes: []Box{}}
+		for _, name := range names {
+			box := userBoxes[name]
+			if !access {
+				box = box.ServedVersions(false)
+			}
+			profile.Boxes = append(profile.Boxes, rebasedBox(box, p.BoxHandler.BaseUrl(), base))
+		}
+		writeJson(w, http.StatusOK, profile)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func updateBoxHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username, boxName := vars["user"], vars["boxname"]
+		var req boxRequest
+		if err := decodeJsonBody(r, &req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+
+		p.mutex.Lock()
+		if !p.known(username, boxName) {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		record := p.record(username, boxName)
+		record.ShortDescription = req.Box.ShortDescription
+		record.Description = req.Box.Description
+		if req.Box.Private != nil {
+			record.Private = *req.Box.Private
+		}
+		record.Updated = publishTimestamp()
+		err := p.save()
+		p.mutex.Unlock()
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not save box")
+			return
+		}
+
+		p.refresh()
+		p.writeBox(w, r, p.BoxHandler.GetBox(username, boxName))
+	}
+	return http.HandlerFunc(fn)
+}
+
+func createVersionHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username, boxName := vars["user"], vars["boxname"]
+		var req versionRequest
+		if err := decodeJsonBody(r, &req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		version := req.Version.Version
+		if _, ok := p.BoxKey(username, boxName, version, "virtualbox", ""); !ok || version == "" {
+			writeJsonError(w, http.StatusUnprocessableEntity, "Invalid version: "+version)
+			return
+		}
+
+		p.mutex.Lock()
+		if !p.known(username, boxName) {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		record := p.record(username, boxName)
+		if record.Versions[version] != nil {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusUnprocessableEntity, "Version "+version+" already exists")
+			return
+		}
+		v := p.versionRecord(record, version)
+		v.Status = VersionUnreleased
+		v.Description = req.Version.Description
+		err := p.save()
+		p.mutex.Unlock()
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not save version")
+			return
+		}
+
+		logger.Info("Created version", "box", username+"/"+boxName, "version", version)
+		p.refresh()
+		p.writeVersion(w, r, username, boxName, version)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func createProviderHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username, boxName, version := vars["user"], vars["boxname"], vars["version"]
+		var req providerRequest
+		if err := decodeJsonBody(r, &req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		provider, architecture := req.Provider.Name, req.Provider.Architecture
+		if _, ok := p.BoxKey(username, boxName, version, provider, architecture); !ok || provider == "" {
+			writeJsonError(w, http.StatusUnprocessableEntity, "Invalid provider: "+provider)
+			return
+		}
+
+		p.mutex.Lock()
+		if !p.knownVersion(username, boxName, version) {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		v := p.versionRecord(p.record(username, boxName), version)
+		now := publishTimestamp()
+		key := providerRecordKey(provider, architecture)
+		rp := v.Providers[key]
+		if rp == nil {
+			rp = &PublishedProvider{Name: provider, Architecture: architecture, Created: now}
+			v.Providers[key] = rp
+		}
+		rp.Url = req.Provider.Url
+		rp.Checksum = req.Provider.Checksum
+		rp.ChecksumType = req.Provider.ChecksumType
+		rp.Updated = now
+		err := p.save()
+		p.mutex.Unlock()
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not save provider")
+			return
+		}
+
+		logger.Info("Created provider", "box", username+"/"+boxName, "version", version, "provider", provider, "architecture", architecture)
+		p.refresh()
+		p.writeProvider(w, r, username, boxName, version, provider, architecture)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func showProviderHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		box := p.BoxHandler.GetBox(vars["user"], vars["boxname"])
+		if !authorizeBox(p.BoxHandler, w, r, box) {
+			return
+		}
+		if box.Name != "" && !canPublish(p.BoxHandler, r, box.Username) && !box.Serves(vars["version"], false) {
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		p.writeProvider(w, r, vars["user"], vars["boxname"], vars["version"], vars["provider"], vars["architecture"])
+	}
+	return http.HandlerFunc(fn)
+}
+
+// uploadUrlHandler hands out a one-off upload path for a provider. Both the
+// classic and the "direct" upload flavours are answered, the callback of the
+// latter being a no-op as the upload lands in the catalog straight away.
+func uploadUrlHandler(p *Publisher, direct bool) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		upload := PendingUpload{Username: vars["user"], Boxname: vars["boxname"], Version: vars["version"], Provider: vars["provider"], Architecture: vars["architecture"]}
+		base, ok := p.BoxHandler.responseBaseUrl(w, r)
+		if !ok {
+			return
+		}
+
+		p.mutex.Lock()
+		record := p.Records[upload.Username+"/"+upload.Boxname]
+		if record == nil || record.Versions[upload.Version] == nil || record.Versions[upload.Version].Providers[providerRecordKey(upload.Provider, upload.Architecture)] == nil {
+			p.mutex.Unlock()
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		token := newUploadToken()
+		p.uploads[token] = upload
+		p.mutex.Unlock()
+
+		response := map[string]string{
+			"upload_path": apiUrl(base, "upload", token),
+			"token":       token,
+		}
+		if direct {
+			response["callback"] = apiUrl(base, "upload", token, "complete")
+		}
+		writeJson(w, http.StatusOK, response)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func uploadHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		token := mux.Vars(r)["token"]
+		p.mutex.Lock()
+		upload, ok := p.uploads[token]
+		p.mutex.Unlock()
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Unknown upload token")
+			return
+		}
+
+		key, ok := p.BoxKey(upload.Username, upload.Boxname, upload.Version, upload.Provider, upload.Architecture)
+		if !ok {
+			writeJsonError(w, http.StatusUnprocessableEntity, "Invalid upload target")
+			return
+		}
+		storage := p.storage()
+		location := storage.Location(key)
+		logger.Info("Receiving upload", "file", location)
+
+		if err := storage.Put(key, r.Body, r.ContentLength); err != nil {
+			logger.Error("Upload failed", "file", location, "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not store upload")
+			return
+		}
+
+		p.mutex.Lock()
+		delete(p.uploads, token)
+		rp := p.versionRecord(p.record(upload.Username, upload.Boxname), upload.Version).Providers[providerRecordKey(upload.Provider, upload.Architecture)]
+		if rp != nil {
+			rp.HostedToken = token
+			rp.Url = ""
+			rp.Updated = publishTimestamp()
+		}
+		err := p.save()
+		p.mutex.Unlock()
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+		}
+
+		logger.Info("Stored upload", "file", location)
+		p.refresh()
+		w.WriteHeader(http.StatusOK)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func uploadCompleteHandler(p *Publisher) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// SetVersionStatus releases, revokes or unreleases a version, which may
+// only exist on disk so far. Versions without providers cannot be released.
+func (p *Publisher) SetVersionStatus(username string, boxName string, version string, status string) error {
+	p.mutex.Lock()
+	p.reload()
+	record := p.Records[username+"/"+boxName]
+	exists := record != nil && record.Versions[version] != nil
+	providers := 0
+	for _, v := range p.BoxHandler.GetBox(username, boxName).Versions {
+		if v.Version == version {
+			exists = true
+			providers = len(v.Providers)
+		}
+	}
+	if !exists {
+		p.mutex.Unlock()
+		return ErrVersionNotFound
+	}
+	if status == VersionActive && providers == 0 {
+		p.mutex.Unlock()
+		return ErrVersionHasNoProviders
+	}
+	v := p.versionRecord(p.record(username, boxName), version)
+	v.Status = status
+	v.Updated = publishTimestamp()
+	err := p.save()
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Set version status", "box", username+"/"+boxName, "version", version, "status", status)
+	p.refresh()
+	return nil
+}
+
+// ForgetVersion removes the publish record of a version whose files have
+// been removed, so it is not listed as waiting for an upload.
+func (p *Publisher) ForgetVersion(username string, boxName string, version string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reload()
+	record := p.Records[username+"/"+boxName]
+	if record == nil || record.Versions[version] == nil {
+		return nil
+	}
+	delete(record.Versions, version)
+	record.Updated = publishTimestamp()
+	return p.save()
+}
+
+// versionStatusHandler backs the release and revoke endpoints.
+func versionStatusHandler(p *Publisher, status string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username, boxName, version := vars["user"], vars["boxname"], vars["version"]
+
+		err := p.SetVersionStatus(username, boxName, version, status)
+		if err == ErrVersionNotFound {
+			writeJsonError(w, http.StatusNotFound, "Resource not found!")
+			return
+		}
+		if err == ErrVersionHasNoProviders {
+			writeJsonError(w, http.StatusUnprocessableEntity, "Version has no providers to release")
+			return
+		}
+		if err != nil {
+			logger.Error("Could not save publish records", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not save version")
+			return
+		}
+		p.writeVersion(w, r, username, boxName, version)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// versionCommand implements `vagrantshadow version stage|release|revoke
+// <user>/<box> <version>`, changing the state kept in the publish directory.
+// A running server picks the change up when it next indexes.
+func versionCommand(p *Publisher, args []string) int {
+	statuses := map[string]string{"stage": VersionUnreleased, "release": VersionActive, "revoke": VersionRevoked}
+	if len(args) != 3 || statuses[args[0]] == "" || !strings.Contains(args[1], "/") {
+		logger.Error("Usage: vagrantshadow version stage|release|revoke <user>/<box> <version>")
+		return 2
+	}
+	name := strings.SplitN(args[1], "/", 2)
+	if err := p.SetVersionStatus(name[0], name[1], args[2], statuses[args[0]]); err != nil {
+		logger.Error("Could not "+args[0]+" version", "box", args[1], "version", args[2], "error", err)
+		return 1
+	}
+	return 0
+}
+
+// writeBox answers with a box, its URLs built for the request.
+func (p *Publisher) writeBox(w http.ResponseWriter, r *http.Request, box Box) {
+	base, ok := p.BoxHandler.responseBaseUrl(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, rebasedBox(box, p.BoxHandler.BaseUrl(), base))
+}
+
+func (p *Publisher) writeVersion(w http.ResponseWriter, r *http.Request, username string, boxName string, version string) {
+	p.writeVersionOf(w, r, p.BoxHandler.GetBox(username, boxName), version)
+}
+
+// writeVersionOf answers with a version of a box, its URLs built for the
+// request.
+func (p *Publisher) writeVersionOf(w http.ResponseWriter, r *http.Request, box Box, version string) {
+	for _, v := range box.Versions {
+		if v.Version == version {
+			base, ok := p.BoxHandler.responseBaseUrl(w, r)
+			if !ok {
+				return
+			}
+			writeJson(w, http.StatusOK, rebasedVersion(v, p.BoxHandler.BaseUrl(), base))
+			return
+		}
+	}
+	writeJsonError(w, http.StatusNotFound, "Resource not found!")
+}
+
+// writeProvider answers with a provider of a version, its URLs built for the
+// request. Without an architecture the provider is chosen as findProvider
+// does.
+func (p *Publisher) writeProvider(w http.ResponseWriter, r *http.Request, username string, boxName string, version string, provider string, architecture string) {
+	base, ok := p.BoxHandler.responseBaseUrl(w, r)
+	if !ok {
+		return
+	}
+	for _, v := range p.BoxHandler.GetBox(username, boxName).Versions {
+		if v.Version == version {
+			if pr, ok := findProvider(v.Providers, provider, architecture); ok {
+				writeJson(w, http.StatusOK, rebasedProvider(pr, p.BoxHandler.BaseUrl(), base))
+				return
+			}
+		}
+	}
+	p.mutex.Lock()
+	record := p.Records[username+"/"+boxName]
+	var rp *PublishedProvider
+	if record != nil && record.Versions[version] != nil {
+		rp = record.Versions[version].Providers[providerRecordKey(provider, architecture)]
+	}
+	p.mutex.Unlock()
+	if rp == nil {
+		writeJsonError(w, http.StatusNotFound, "Resource not found!")
+		return
+	}
+	// Created but nothing uploaded yet.
+	writeJson(w, http.StatusOK, Provider{
+		Name:         rp.Name,
+		Architecture: rp.Architecture,
+		Hosted:       "true",
+		UploadUrl:    uploadUrl(base, username, boxName, version, rp.Name, rp.Architecture),
+		Created:      rp.Created,
+		Updated:      rp.Updated,
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func newTestPublisher(t *testing.T) (*Publisher, *mux.Router, string) {
+	dir, err := ioutil.TempDir("", "vagrantshadow-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, OpenPublish: true}
+	p := &Publisher{BoxHandler: bh, Directory: dir}
+	p.Refresh = func() { bh.PopulateBoxes([]string{dir}, &port, &host) }
+	p.Load()
+	bh.Publisher = p
+	p.Refresh()
+
+	m := mux.NewRouter()
+	m.Handle("/api/v1/boxes", createBoxHandler(p)).Methods("POST")
+	m.Handle("/api/v1/box/{user}/{boxname}", showBoxHandler(p)).Methods("GET")
+	m.Handle("/api/v1/user/{user}", showUserHandler(p)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}", showVersionHandler(p)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/versions", createVersionHandler(p)).Methods("POST")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/providers", createProviderHandler(p)).Methods("POST")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}", showProviderHandler(p)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/upload", uploadUrlHandler(p, false)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/{architecture}", showProviderHandler(p)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/{architecture}/upload", uploadUrlHandler(p, false)).Methods("GET")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/release", versionStatusHandler(p, VersionActive)).Methods("PUT")
+	m.Handle("/api/v1/upload/{token}", uploadHandler(p)).Methods("PUT")
+	return p, m, dir
+}
+
+func doRequest(m http.Handler, method string, url string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+	return w
+}
+
+func TestCanPublishBoxThroughApi(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+
+	w := doRequest(m, "GET", "/api/v1/box/benphegan/dev", "")
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "dev", "short_description": "Development box"}}`)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = doRequest(m, "POST", "/api/v1/box/benphegan/dev/versions", `{"version": {"version": "1.2.0", "description": "First"}}`)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = doRequest(m, "POST", "/api/v1/box/benphegan/dev/version/1.2.0/providers", `{"provider": {"name": "virtualbox"}}`)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/1.2.0/provider/virtualbox/upload", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var upload map[string]string
+	json.Unmarshal(w.Body.Bytes(), &upload)
+	assert.Equal("http://localhost:8099/api/v1/upload/"+upload["token"], upload["upload_path"])
+
+	w = doRequest(m, "PUT", "/api/v1/upload/"+upload["token"], "box contents")
+	assert.Equal(http.StatusOK, w.Code)
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.2.0__virtualbox.box"))
+	assert.Nil(err)
+	assert.Equal("box contents", string(contents))
+
+	w = doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/1.2.0/provider/virtualbox", "")
+	var provider Provider
+	json.Unmarshal(w.Body.Bytes(), &provider)
+	assert.Equal(upload["token"], provider.HostedToken)
+
+	w = doRequest(m, "PUT", "/api/v1/box/benphegan/dev/version/1.2.0/release", "")
+	assert.Equal(http.StatusOK, w.Code)
+
+	box := p.BoxHandler.GetBox("benphegan", "dev")
+	assert.Equal("Development box", box.ShortDescription)
+	assert.Equal("active", box.CurrentVersion.Status)
+	assert.Equal("http://localhost:8099/api/v1/box/benphegan/dev/version/1.2.0/release", box.CurrentVersion.ReleaseUrl)
+	assert.Equal("http://localhost:8099/api/v1/box/benphegan/dev/version/1.2.0/provider/virtualbox/upload", box.CurrentVersion.Providers[0].UploadUrl)
+}
+
+func TestPublishingArchitecturesOfAProvider(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "dev"}}`)
+	doRequest(m, "POST", "/api/v1/box/benphegan/dev/versions", `{"version": {"version": "1.0"}}`)
+
+	tokens := map[string]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		w := doRequest(m, "POST", "/api/v1/box/benphegan/dev/version/1.0/providers", `{"provider": {"name": "virtualbox", "architecture": "`+arch+`"}}`)
+		assert.Equal(http.StatusOK, w.Code)
+		var provider Provider
+		json.Unmarshal(w.Body.Bytes(), &provider)
+		assert.Equal(arch, provider.Architecture)
+		assert.Equal("http://localhost:8099/api/v1/box/benphegan/dev/version/1.0/provider/virtualbox/"+arch+"/upload", provider.UploadUrl)
+
+		var upload map[string]string
+		json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/1.0/provider/virtualbox/"+arch+"/upload", "").Body.Bytes(), &upload)
+		assert.Equal(http.StatusOK, doRequest(m, "PUT", "/api/v1/upload/"+upload["token"], arch+" box").Code)
+		tokens[arch] = upload["token"]
+	}
+	assert.NotEqual(tokens["amd64"], tokens["arm64"])
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox__"+arch+".box"))
+		assert.Nil(err)
+		assert.Equal(arch+" box", string(contents))
+
+		var provider Provider
+		json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/1.0/provider/virtualbox/"+arch, "").Body.Bytes(), &provider)
+		assert.Equal(arch, provider.Architecture)
+		assert.Equal(tokens[arch], provider.HostedToken)
+	}
+	providers := p.BoxHandler.GetBox("benphegan", "dev").Versions[0].Providers
+	assert.Equal(2, len(providers))
+	assert.NotEqual(providers[0].UploadUrl, providers[1].UploadUrl)
+}
+
+func TestProvidersNeedAnExistingVersion(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "dev"}}`)
+
+	w := doRequest(m, "POST", "/api/v1/box/benphegan/dev/version/9.9/providers", `{"provider": {"name": "virtualbox"}}`)
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Nil(p.Records["benphegan/dev"].Versions["9.9"])
+	assert.Equal(0, len(p.BoxHandler.GetBox("benphegan", "dev").Versions))
+
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("box"), 0644)
+	p.Refresh()
+	w = doRequest(m, "POST", "/api/v1/box/benphegan/dev/version/1.0/providers", `{"provider": {"name": "vmware_desktop"}}`)
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestPublishRecordsSurviveRestart(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+
+	doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "dev", "short_description": "Development box"}}`)
+	doRequest(m, "POST", "/api/v1/box/benphegan/dev/versions", `{"version": {"version": "2.0"}}`)
+
+	restarted := &Publisher{BoxHandler: p.BoxHandler, Directory: dir}
+	restarted.Load()
+	assert.Equal("Development box", restarted.Records["benphegan/dev"].ShortDescription)
+	assert.Equal("unreleased", restarted.Records["benphegan/dev"].Versions["2.0"].Status)
+}
+
+func TestRejectsUnservableNames(t *testing.T) {
+	assert := assert.New(t)
+	_, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+
+	w := doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "../dev"}}`)
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestVersionLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	bh := p.BoxHandler
+	bh.Tokens = &TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	token, _ := bh.Tokens.Add("benphegan", false, "tester")
+	m.Handle("/{user}/{boxname}", getBox(bh, "localhost")).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("one"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"), []byte("two"), 0644)
+	p.Refresh()
+
+	assert.Equal(0, versionCommand(p, []string{"stage", "benphegan/dev", "2.0"}))
+	assert.Equal("1.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+
+	var box Box
+	json.Unmarshal(doRequest(m, "GET", "/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal(1, len(box.Versions))
+	assert.Equal("1.0", box.CurrentVersion.Version)
+	json.Unmarshal(doRequest(m, "GET", "/benphegan/dev?access_token="+token, "").Body.Bytes(), &box)
+	assert.Equal(2, len(box.Versions))
+	assert.Equal("1.0", box.CurrentVersion.Version)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/benphegan/dev/2.0/virtualbox/virtualbox.box", "").Code)
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/benphegan/dev/2.0/virtualbox/virtualbox.box?access_token="+token, "").Code)
+
+	w := doRequest(m, "PUT", "/api/v1/box/benphegan/dev/version/2.0/release", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("2.0", bh.GetBox("benphegan", "dev").CurrentVersion.Version)
+
+	assert.Equal(0, versionCommand(p, []string{"revoke", "benphegan/dev", "1.0"}))
+	json.Unmarshal(doRequest(m, "GET", "/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal(1, len(box.Versions))
+	assert.Equal("2.0", box.Versions[0].Version)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "").Code)
+	_, err := os.Stat(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"))
+	assert.Nil(err)
+
+	assert.Equal(1, versionCommand(p, []string{"release", "benphegan/dev", "3.0"}))
+}
+
+func TestVersionsWithoutProvidersAreNotReleased(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("one"), 0644)
+	p.Refresh()
+	assert.Equal(http.StatusOK, doRequest(m, "POST", "/api/v1/box/benphegan/dev/versions", `{"version": {"version": "2.0"}}`).Code)
+
+	w := doRequest(m, "PUT", "/api/v1/box/benphegan/dev/version/2.0/release", "")
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(1, versionCommand(p, []string{"release", "benphegan/dev", "2.0"}))
+	var box Box
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal("1.0", box.CurrentVersion.Version)
+
+	// A released version whose files have gone is passed over.
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"), []byte("two"), 0644)
+	p.Refresh()
+	assert.Equal(http.StatusOK, doRequest(m, "PUT", "/api/v1/box/benphegan/dev/version/2.0/release", "").Code)
+	assert.Equal("2.0", p.BoxHandler.GetBox("benphegan", "dev").CurrentVersion.Version)
+	os.Remove(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"))
+	p.Refresh()
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal("1.0", box.CurrentVersion.Version)
+}
+
+func TestPublishingIsRefusedWithoutTokens(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	p.BoxHandler.OpenPublish = false
+	for _, name := range []string{"benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box", "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("box"), 0644)
+	}
+	p.Refresh()
+	assert.Equal(0, versionCommand(p, []string{"stage", "benphegan/dev", "2.0"}))
+
+	assert.Equal(http.StatusForbidden, doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "other"}}`).Code)
+	var box Box
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal(1, len(box.Versions))
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/2.0", "").Code)
+
+	p.BoxHandler.OpenPublish = true
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/box/benphegan/dev", "").Body.Bytes(), &box)
+	assert.Equal(2, len(box.Versions))
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/2.0", "").Code)
+}
+
+func TestReadApiHidesWhatCallersCannotSee(t *testing.T) {
+	assert := assert.New(t)
+	p, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	bh := p.BoxHandler
+	bh.PrivateBoxes = []string{"benphegan/secret"}
+	bh.Tokens = &TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	token, _ := bh.Tokens.Add("benphegan", false, "tester")
+	for _, name := range []string{
+		"benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box",
+		"benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box",
+		"benphegan-VAGRANTSLASH-secret__1.0__virtualbox.box",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("box"), 0644)
+	}
+	p.Refresh()
+	assert.Equal(0, versionCommand(p, []string{"stage", "benphegan/dev", "2.0"}))
+
+	var version Version
+	w := doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/1.0", "")
+	assert.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &version)
+	assert.Equal("1.0", version.Version)
+	assert.Equal("virtualbox", version.Providers[0].Name)
+
+	for _, url := range []string{
+		"/api/v1/box/benphegan/dev/version/2.0",
+		"/api/v1/box/benphegan/dev/version/2.0/provider/virtualbox",
+		"/api/v1/box/benphegan/dev/version/9.9",
+		"/api/v1/box/benphegan/secret/version/1.0",
+		"/api/v1/user/nobody",
+	} {
+		assert.Equal(http.StatusNotFound, doRequest(m, "GET", url, "").Code, url)
+	}
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/2.0?access_token="+token, "").Code)
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/api/v1/box/benphegan/dev/version/2.0/provider/virtualbox?access_token="+token, "").Code)
+
+	var profile UserProfile
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/user/benphegan", "").Body.Bytes(), &profile)
+	assert.Equal("benphegan", profile.Username)
+	assert.Equal(1, len(profile.Boxes))
+	assert.Equal("benphegan/dev", profile.Boxes[0].Name)
+	assert.Equal(1, len(profile.Boxes[0].Versions))
+
+	json.Unmarshal(doRequest(m, "GET", "/api/v1/user/benphegan?access_token="+token, "").Body.Bytes(), &profile)
+	assert.Equal(2, len(profile.Boxes))
+	assert.Equal("benphegan/secret", profile.Boxes[1].Name)
+	assert.Equal(2, len(profile.Boxes[0].Versions))
+}
+
+func TestPublishRecordsAreReloadedWhenChanged(t *testing.T) {
+	assert := assert.New(t)
+	p, _, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box"), []byte("one"), 0644)
+	p.Refresh()
+
+	other := &Publisher{BoxHandler: p.BoxHandler, Directory: dir}
+	other.Load()
+	assert.Nil(other.SetVersionStatus("benphegan", "dev", "1.0", VersionRevoked))
+
+	p.Refresh()
+	assert.Nil(p.BoxHandler.GetBox("benphegan", "dev").CurrentVersion)
+	assert.Equal(VersionRevoked, p.BoxHandler.GetBox("benphegan", "dev").Versions[0].Status)
+}
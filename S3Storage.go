@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds the connection settings shared by every s3:// directory.
+type S3Config struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// S3Storage keeps boxes in an S3 compatible object store, addressed path
+// style (endpoint/bucket/key) so that MinIO and friends work out of the box.
+type S3Storage struct {
+	Config S3Config
+	Bucket string
+	Prefix string
+	// PartSize is the size above which uploads are sent as a multipart
+	// upload, and the size of each part.
+	PartSize int64
+	Client   *http.Client
+}
+
+// NewS3Storage returns the storage for an s3://bucket/prefix URL.
+func NewS3Storage(config S3Config, location string) *S3Storage {
+	trimmed := strings.TrimPrefix(location, "s3://")
+	parts := strings.SplitN(trimmed, "/", 2)
+	s := &S3Storage{Config: config, Bucket: parts[0], PartSize: 64 << 20, Client: http.DefaultClient}
+	if len(parts) == 2 {
+		s.Prefix = strings.Trim(parts[1], "/")
+	}
+	return s
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+type s3InitiateMultipartResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *S3Storage) objectKey(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return s.Prefix + "/" + key
+}
+
+func (s *S3Storage) Location(key string) string {
+	return "s3://" + s.Bucket + "/" + s.objectKey(key)
+}
+
+func (s *S3Storage) List(recursive bool) ([]StorageObject, error) {
+	objects := []StorageObject{}
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if !recursive {
+			query.Set("delimiter", "/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, -1, nil)
+		if err != nil {
+			return objects, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return objects, err
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, StorageObject{Key: strings.TrimPrefix(c.Key, prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) Stat(key string) (StorageObject, error) {
+	resp, err := s.do("HEAD", s.objectKey(key), nil, nil, -1, nil)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3Storage) OpenRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	headers := map[string]string{}
+	if length >= 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	} else if offset > 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-", offset)
+	}
+	resp, err := s.do("GET", s.objectKey(key), nil, nil, -1, headers)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put sends small objects in a single request and anything larger than
+// PartSize, or of unknown size, as a multipart upload.
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	if size >= 0 && size <= s.PartSize {
+		resp, err := s.do("PUT", s.objectKey(key), nil, r, size, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	resp, err := s.do("POST", s.objectKey(key), url.Values{"uploads": {""}}, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	initiated := s3InitiateMultipartResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	complete := s3CompleteMultipartUpload{}
+	buffer := make([]byte, s.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(r, buffer)
+		if n > 0 || partNumber == 1 {
+			query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadId}}
+			resp, err := s.do("PUT", s.objectKey(key), query, bytes.NewReader(buffer[:n]), int64(n), nil)
+			if err != nil {
+				s.abortMultipart(key, initiated.UploadId)
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			s.abortMultipart(key, initiated.UploadId)
+			return readErr
+		}
+	}
+
+	body, _ := xml.Marshal(complete)
+	resp, err = s.do("POST", s.objectKey(key), url.Values{"uploadId": {initiated.UploadId}}, bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		s.abortMultipart(key, initiated.UploadId)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.objectKey(key), nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) abortMultipart(key string, uploadId string) {
+	if resp, err := s.do("DELETE", s.objectKey(key), url.Values{"uploadId": {uploadId}}, nil, 0, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do sends a signed request, turning error responses into errors.
+func (s *S3Storage) do(method string, objectKey string, query url.Values, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket
+	if objectKey != "" {
+		endpoint.Path += "/" + objectKey
+	}
+	endpoint.RawPath = s3EscapePath(endpoint.Path)
+	endpoint.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrStorageObjectNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		s3err := s3Error{}
+		xml.Unmarshal(data, &s3err)
+		return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, objectKey, resp.Status, s3err.Code, s3err.Message)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 Authorization header. Payloads are
+// not hashed, so that box uploads can be streamed.
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.Config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Config.SessionToken)
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + signed[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.Config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := s3Hmac([]byte("AWS4"+s.Config.SecretKey), date)
+	key = s3Hmac(key, s.Config.Region)
+	key = s3Hmac(key, "s3")
+	key = s3Hmac(key, "aws4_request")
+	signature := hex.EncodeToString(s3Hmac(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.Config.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes everything but the unreserved characters, as
+// signature version 4 requires.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
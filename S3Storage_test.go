@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3 compatible server, enough
+// to exercise listing, ranged reads and both upload flavours.
+type fakeS3 struct {
+	mutex        sync.Mutex
+	objects      map[string][]byte
+	parts        map[string]map[int][]byte
+	unsigned     int
+	multipartPut int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, parts: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		f.unsigned++
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == "GET" && key == "":
+		f.list(w, query.Get("prefix"), query.Get("delimiter"))
+	case r.Method == "POST" && query.Get("uploads") == "" && len(query["uploads"]) > 0:
+		f.parts[key] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := ioutil.ReadAll(r.Body)
+		f.parts[key][number] = data
+		f.multipartPut++
+		w.Header().Set("ETag", `"`+strconv.Itoa(number)+`"`)
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		complete := s3CompleteMultipartUpload{}
+		xml.NewDecoder(r.Body).Decode(&complete)
+		var data []byte
+		for _, p := range complete.Parts {
+			data = append(data, f.parts[key][p.PartNumber]...)
+		}
+		f.objects[key] = data
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == "DELETE" && query.Get("uploadId") == "":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "HEAD" || r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(1500000000, 0).UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, key, time.Unix(1500000000, 0), bytes.NewReader(data))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string, delimiter string) {
+	keys := []string{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(key, prefix), delimiter) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2017-07-14T02:40:00.000Z</LastModified></Contents>", key, len(f.objects[key]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func newTestS3Storage(server *httptest.Server) *S3Storage {
+	config := S3Config{Endpoint: server.URL, Region: "us-east-1", AccessKey: "key", SecretKey: "secret"}
+	return NewS3Storage(config, "s3://boxes/vagrant")
+}
+
+func TestS3StorageCanListAndReadObjects(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeS3()
+	fake.objects["vagrant/ben-VAGRANTSLASH-box__1.0.0__virtualbox.box"] = []byte("box contents")
+	fake.objects["vagrant/ben/other/1.0.0/virtualbox.box"] = []byte("tree box")
+	fake.objects["elsewhere.box"] = []byte("not ours")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestS3Storage(server)
+
+	objects, err := s.List(false)
+	assert.Nil(err)
+	assert.Equal(1, len(objects))
+	assert.Equal("ben-VAGRANTSLASH-box__1.0.0__virtualbox.box", objects[0].Key)
+	assert.Equal(int64(12), objects[0].Size)
+
+	objects, err = s.List(true)
+	assert.Nil(err)
+	assert.Equal(2, len(objects))
+
+	object, err := s.Stat("ben-VAGRANTSLASH-box__1.0.0__virtualbox.box")
+	assert.Nil(err)
+	assert.Equal(int64(12), object.Size)
+
+	_, err = s.Stat("missing.box")
+	assert.Equal(ErrStorageObjectNotFound, err)
+
+	reader := newStorageReader(s, object.Key, object.Size)
+	buffer := make([]byte, 8)
+	n, err := reader.ReadAt(buffer, 4)
+	assert.Equal(8, n)
+	assert.Equal("contents", string(buffer))
+	assert.Equal("s3://boxes/vagrant/ben-VAGRANTSLASH-box__1.0.0__virtualbox.box", s.Location(object.Key))
+
+	assert.Nil(s.Delete(object.Key))
+	_, err = s.Stat(object.Key)
+	assert.Equal(ErrStorageObjectNotFound, err)
+	assert.Equal(0, fake.unsigned)
+}
+
+func TestS3StorageUploadsLargeObjectsInParts(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestS3Storage(server)
+	s.PartSize = 4
+
+	assert.Nil(s.Put("small.box", strings.NewReader("tiny"), 4))
+	assert.Equal("tiny", string(fake.objects["vagrant/small.box"]))
+	assert.Equal(0, fake.multipartPut)
+
+	assert.Nil(s.Put("large.box", strings.NewReader("box contents"), -1))
+	assert.Equal("box contents", string(fake.objects["vagrant/large.box"]))
+	assert.Equal(3, fake.multipartPut)
+	assert.Equal(0, fake.unsigned)
+}
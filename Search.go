@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// searchLimit is the largest page of results a search returns.
+const searchLimit = 100
+
+// SearchQuery holds the parameters of /api/v1/search.
+type SearchQuery struct {
+	Query    string
+	Provider string
+	Sort     string
+	Order    string
+	Limit    int
+	Page     int
+}
+
+// parseSearchQuery reads search parameters, defaulting them as Vagrant Cloud
+// does: most downloaded first, ten boxes to a page. The second result
+// describes the first invalid parameter.
+func parseSearchQuery(r *http.Request) (SearchQuery, string) {
+	values := r.URL.Query()
+	sq := SearchQuery{
+		Query:    values.Get("q"),
+		Provider: values.Get("provider"),
+		Sort:     values.Get("sort"),
+		Order:    values.Get("order"),
+		Limit:    10,
+		Page:     1,
+	}
+	if sq.Sort == "" {
+		sq.Sort = "downloads"
+	}
+	if sq.Sort != "downloads" && sq.Sort != "created" && sq.Sort != "updated" {
+		return sq, "sort must be one of downloads, created or updated"
+	}
+	if sq.Order == "" {
+		sq.Order = "desc"
+	}
+	if sq.Order != "desc" && sq.Order != "asc" {
+		return sq, "order must be desc or asc"
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > searchLimit {
+			return sq, "limit must be between 1 and " + strconv.Itoa(searchLimit)
+		}
+		sq.Limit = n
+	}
+	if page := values.Get("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		// Pages are capped so that the offset of the first result cannot
+		// overflow.
+		if err != nil || n < 1 || n > math.MaxInt32/searchLimit {
+			return sq, "page must be between 1 and " + strconv.Itoa(math.MaxInt32/searchLimit)
+		}
+		sq.Page = n
+	}
+	return sq, ""
+}
+
+// matches reports whether every word of the query appears in the box's name
+// or descriptions, and whether it has a version served for the provider.
+func (sq SearchQuery) matches(box Box) bool {
+	text := strings.ToLower(box.Name + " " + box.ShortDescription + " " + box.DescriptionMarkdown)
+	for _, word := range strings.Fields(strings.ToLower(sq.Query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	if len(box.Versions) == 0 {
+		return false
+	}
+	if sq.Provider == "" {
+		return true
+	}
+	for _, v := range box.Versions {
+		for _, p := range v.Providers {
+			if p.Name == sq.Provider {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Search returns a page of the boxes that match a query. boxes are the boxes
+// the caller can see, with only the versions they can see.
+func (sq SearchQuery) Search(boxes []Box) []Box {
+	results := []Box{}
+	for _, box := range boxes {
+		if sq.matches(box) {
+			results = append(results, box)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if sq.Order == "desc" {
+			a, b = b, a
+		}
+		switch sq.Sort {
+		case "created":
+			if a.Created != b.Created {
+				return a.Created < b.Created
+			}
+		case "updated":
+			if a.Updated != b.Updated {
+				return a.Updated < b.Updated
+			}
+		default:
+			if a.Downloads != b.Downloads {
+				return a.Downloads < b.Downloads
+			}
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	start := (sq.Page - 1) * sq.Limit
+	if start >= len(results) {
+		return []Box{}
+	}
+	end := start + sq.Limit
+	if end > len(results) {
+		end = len(results)
+	}
+	return results[start:end]
+}
+
+func searchHandler(bh *BoxHandler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sq, problem := parseSearchQuery(r)
+		if problem != "" {
+			writeJsonError(w, http.StatusUnprocessableEntity, problem)
+			return
+		}
+		base, ok := bh.responseBaseUrl(w, r)
+		if !ok {
+			return
+		}
+		boxes := []Box{}
+		for user, boxinfo := range bh.Boxes() {
+			access := hasAccess(bh, r, user)
+			for _, box := range boxinfo {
+				if box.Private && !access {
+					continue
+				}
+				boxes = append(boxes, box.ServedVersions(access))
+			}
+		}
+		results := sq.Search(boxes)
+		for i := range results {
+			results[i] = rebasedBox(results[i], bh.BaseUrl(), base)
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{"boxes": results})
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func searchNames(t *testing.T, m http.Handler, url string) []string {
+	w := doRequest(m, "GET", url, "")
+	if w.Code != http.StatusOK {
+		t.Fatal(url + " answered " + w.Body.String())
+	}
+	var response struct {
+		Boxes []Box `json:"boxes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	names := []string{}
+	for _, box := range response.Boxes {
+		names = append(names, box.Name)
+	}
+	return names
+}
+
+func TestSearch(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-search")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box",
+		"acme-VAGRANTSLASH-ubuntu__1.0__vmware.box",
+		"acme-VAGRANTSLASH-centos__1.0__virtualbox.box",
+		"benphegan-VAGRANTSLASH-dev__1.0__virtualbox.box",
+		"benphegan-VAGRANTSLASH-secret__1.0__virtualbox.box",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("box"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev.yaml"), []byte("short_description: Ubuntu development box\n"), 0644)
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, PrivateBoxes: []string{"benphegan/secret"}}
+	bh.Tokens = &TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	token, _ := bh.Tokens.Add("benphegan", false, "")
+	bh.Stats = &DownloadStats{}
+	for i := 0; i < 3; i++ {
+		bh.Stats.Record("acme", "centos", "1.0")
+	}
+	bh.Stats.Record("benphegan", "dev", "1.0")
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+
+	m := mux.NewRouter()
+	m.Handle("/api/v1/search", searchHandler(bh)).Methods("GET")
+
+	assert.Equal([]string{"acme/centos", "benphegan/dev", "acme/ubuntu"}, searchNames(t, m, "/api/v1/search"))
+	assert.Equal([]string{"acme/ubuntu", "benphegan/dev", "acme/centos"}, searchNames(t, m, "/api/v1/search?order=asc"))
+	assert.Equal([]string{"benphegan/dev", "acme/ubuntu"}, searchNames(t, m, "/api/v1/search?q=UBUNTU"))
+	assert.Equal([]string{"benphegan/dev"}, searchNames(t, m, "/api/v1/search?q=ubuntu+development"))
+	assert.Equal([]string{"acme/ubuntu"}, searchNames(t, m, "/api/v1/search?provider=vmware"))
+	assert.Equal([]string{"benphegan/dev"}, searchNames(t, m, "/api/v1/search?limit=1&page=2"))
+	assert.Equal([]string{}, searchNames(t, m, "/api/v1/search?limit=1&page=9"))
+	assert.Equal([]string{}, searchNames(t, m, "/api/v1/search?limit=100&page=21474836"))
+	assert.Equal(4, len(searchNames(t, m, "/api/v1/search?access_token="+token)))
+	assert.Equal(3, len(searchNames(t, m, "/api/v1/search?sort=created")))
+
+	for _, url := range []string{"/api/v1/search?sort=name", "/api/v1/search?order=up", "/api/v1/search?limit=1000", "/api/v1/search?page=0", "/api/v1/search?page=1844674407370955162&limit=10"} {
+		w := doRequest(m, "GET", url, "")
+		assert.Equal(http.StatusUnprocessableEntity, w.Code, url)
+	}
+
+	w := doRequest(m, "GET", "/api/v1/search?q=centos", "")
+	var response map[string][]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(float64(3), response["boxes"][0]["downloads"])
+	assert.NotNil(response["boxes"][0]["current_version"])
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is somewhere box files are kept. Keys are slash separated paths
+// relative to the root of the storage.
+type Storage interface {
+	// Location returns a unique, human readable name for a key, such as a
+	// file path or an s3:// URL.
+	Location(key string) string
+	// List returns the objects directly below the root, or every object
+	// below it when recursive is set.
+	List(recursive bool) ([]StorageObject, error)
+	Stat(key string) (StorageObject, error)
+	// OpenRange reads length bytes starting at offset, or the rest of the
+	// object if length is negative.
+	OpenRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Put stores an object of the given size. A size of -1 means unknown.
+	Put(key string, r io.Reader, size int64) error
+	Delete(key string) error
+}
+
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+var ErrStorageObjectNotFound = errors.New("object not found")
+
+// StorageFor returns the storage behind an entry of the directory list.
+// s3://bucket/prefix entries are served from S3 using the handler's S3
+// settings, anything else is a local directory.
+func (bh *BoxHandler) StorageFor(directory string) Storage {
+	if strings.HasPrefix(directory, "s3://") {
+		return NewS3Storage(bh.S3, directory)
+	}
+	return &FileStorage{Root: absoluteDirectory(directory)}
+}
+
+// isRemoteDirectory reports whether an entry of the directory list is served
+// from somewhere other than the local file system.
+func isRemoteDirectory(directory string) bool {
+	return strings.HasPrefix(directory, "s3://")
+}
+
+// readStorageObject reads a small object, such as a descriptor, in full.
+func readStorageObject(s Storage, key string) ([]byte, error) {
+	rc, err := s.OpenRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, 1<<20))
+}
+
+// FileStorage keeps boxes in a local directory.
+type FileStorage struct {
+	Root string
+}
+
+func (fs *FileStorage) Location(key string) string {
+	return filepath.Join(fs.Root, filepath.FromSlash(key))
+}
+
+func (fs *FileStorage) List(recursive bool) ([]StorageObject, error) {
+	objects := []StorageObject{}
+	if !recursive {
+		infos, err := ioutil.ReadDir(fs.Root)
+		if err != nil {
+			return objects, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				objects = append(objects, StorageObject{Key: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+		return objects, nil
+	}
+	err := filepath.Walk(fs.Root, func(location string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(fs.Root, location)
+		objects = append(objects, StorageObject{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (fs *FileStorage) Stat(key string) (StorageObject, error) {
+	info, err := os.Stat(fs.Location(key))
+	if os.IsNotExist(err) {
+		return StorageObject{}, ErrStorageObjectNotFound
+	}
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return StorageObject{}, ErrStorageObjectNotFound
+	}
+	return StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (fs *FileStorage) OpenRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(fs.Location(key))
+	if os.IsNotExist(err) {
+		return nil, ErrStorageObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return limitedReadCloser{io.LimitReader(f, length), f}, nil
+}
+
+// Put writes to a name the indexer ignores and renames it into place once
+// complete, so a half written box is never served.
+func (fs *FileStorage) Put(key string, r io.Reader, size int64) error {
+	location := fs.Location(key)
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return err
+	}
+	partial := filepath.Join(filepath.Dir(location), "."+filepath.Base(location)+".part")
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, location)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return err
+}
+
+func (fs *FileStorage) Delete(key string) error {
+	err := os.Remove(fs.Location(key))
+	if os.IsNotExist(err) {
+		return ErrStorageObjectNotFound
+	}
+	return err
+}
+
+// storageReader presents an object in storage as an io.ReadSeeker and
+// io.ReaderAt, opening a ranged read whenever it has to start reading from a
+// new offset. This lets http.ServeContent answer range requests for any
+// storage.
+type storageReader struct {
+	storage Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func newStorageReader(s Storage, key string, size int64) *storageReader {
+	return &storageReader{storage: s, key: key, size: size}
+}
+
+func (sr *storageReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.size {
+		return 0, io.EOF
+	}
+	if sr.body == nil {
+		body, err := sr.storage.OpenRange(sr.key, sr.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		sr.body = body
+	}
+	n, err := sr.body.Read(p)
+	sr.offset += int64(n)
+	return n, err
+}
+
+func (sr *storageReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != sr.offset && sr.body != nil {
+		sr.body.Close()
+		sr.body = nil
+	}
+	sr.offset = offset
+	return offset, nil
+}
+
+func (sr *storageReader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= sr.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if offset+length > sr.size {
+		length = sr.size - offset
+	}
+	rc, err := sr.storage.OpenRange(sr.key, offset, length)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p[:length])
+	if err == nil && int64(n) < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (sr *storageReader) Close() error {
+	if sr.body != nil {
+		return sr.body.Close()
+	}
+	return nil
+}
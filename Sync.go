@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/mcuadros/go-version"
+)
+
+// Sync copies boxes from another vagrantshadow, or any server answering the
+// Vagrant Cloud search API, into Directory using the local naming scheme.
+// Only released versions of boxes matching Boxes, user/box patterns such as
+// acme/*, and Constraint, such as ">= 1.0, < 2.0", are copied. Boxes found
+// in any indexed directory are left alone.
+type Sync struct {
+	Source     string
+	Token      string
+	Boxes      []string
+	Constraint string
+	Directory  string
+	BoxHandler *BoxHandler
+	Client     *http.Client
+}
+
+// SyncFile is a box file missing from this server.
+type SyncFile struct {
+	Username     string
+	Boxname      string
+	Version      string
+	Provider     string
+	Architecture string
+	Url          string
+	Checksum     string
+	ChecksumType string
+}
+
+func (f SyncFile) String() string {
+	if f.Architecture != "" {
+		return f.Username + "/" + f.Boxname + "/" + f.Version + "/" + f.Provider + "/" + f.Architecture
+	}
+	return f.Username + "/" + f.Boxname + "/" + f.Version + "/" + f.Provider
+}
+
+func (s *Sync) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// get requests a URL, sending the token only to the source server.
+func (s *Sync) get(url string, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" && strings.HasPrefix(url, strings.TrimRight(s.Source, "/")+"/") {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	return s.client().Do(req)
+}
+
+// Catalog reads every box the source lets us see, a page of search results
+// at a time.
+func (s *Sync) Catalog() ([]Box, error) {
+	boxes := []Box{}
+	for page := 1; ; page++ {
+		resp, err := s.get(strings.TrimRight(s.Source, "/")+"/api/v1/search?sort=created&order=asc&limit="+strconv.Itoa(searchLimit)+"&page="+strconv.Itoa(page), "")
+		if err != nil {
+			return nil, err
+		}
+		var results struct {
+			Boxes []Box `json:"boxes"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New("search answered " + resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&results)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, results.Boxes...)
+		if len(results.Boxes) < searchLimit {
+			return boxes, nil
+		}
+	}
+}
+
+// selected reports whether a box is one of those being synced.
+func (s *Sync) selected(name string) bool {
+	if len(s.Boxes) == 0 {
+		return true
+	}
+	for _, pattern := range s.Boxes {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the selected box files the source has and this server
+// does not.
+func (s *Sync) Missing() ([]SyncFile, error) {
+	boxes, err := s.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	var constraint *version.ConstraintGroup
+	if s.Constraint != "" {
+		// Vagrant writes pessimistic constraints as ~> rather than ~.
+		constraint = version.NewConstrainGroupFromString(strings.Replace(s.Constraint, "~>", "~", -1))
+	}
+	missing := []SyncFile{}
+	for _, box := range boxes {
+		parts := strings.SplitN(box.Name, "/", 2)
+		if len(parts) != 2 || !s.selected(box.Name) {
+			continue
+		}
+		for _, v := range box.Versions {
+			if v.Status != VersionActive || constraint != nil && !constraint.Match(v.Version) {
+				continue
+			}
+			for _, p := range v.Providers {
+				if _, ok := s.BoxHandler.GetBoxFile(parts[0], parts[1], p.Name, p.Architecture, v.Version); ok {
+					continue
+				}
+				// The URLs in the metadata are built for the source's own
+				// hostname, which need not be the address it is synced from.
+				f := SyncFile{Username: parts[0], Boxname: parts[1], Version: v.Version, Provider: p.Name, Architecture: p.Architecture, Checksum: p.Checksum, ChecksumType: p.ChecksumType}
+				f.Url = providerUrl(strings.TrimRight(s.Source, "/"), f.Username, f.Boxname, f.Version, f.Provider, f.Architecture)
+				if _, ok := s.BoxHandler.BoxKey(s.Directory, f.Username, f.Boxname, f.Version, f.Provider, f.Architecture); !ok {
+					logger.Info("Skipping box file, it cannot be stored here", "file", f.String())
+					continue
+				}
+				missing = append(missing, f)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// partialLocation is where a download is kept until it is complete, so an
+// interrupted sync carries on where it left off. Downloads to S3 are kept
+// in the temporary directory.
+func (s *Sync) partialLocation(key string) string {
+	storage := s.BoxHandler.StorageFor(s.Directory)
+	if fs, ok := storage.(*FileStorage); ok {
+		location := fs.Location(key)
+		return filepath.Join(filepath.Dir(location), "."+filepath.Base(location)+".sync")
+	}
+	return filepath.Join(os.TempDir(), "vagrantshadow-sync", strings.Replace(key, "/", "__", -1)+".sync")
+}
+
+// Fetch downloads a box file, resuming an earlier attempt, checks it
+// against its checksum and moves it into place.
+func (s *Sync) Fetch(f SyncFile) error {
+	key, ok := s.BoxHandler.BoxKey(s.Directory, f.Username, f.Boxname, f.Version, f.Provider, f.Architecture)
+	if !ok {
+		return errors.New("cannot be stored in " + s.Directory)
+	}
+	partial := s.partialLocation(key)
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err == nil {
+		err = s.download(out, f.Url, offset)
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if h := newChecksumHash(f.ChecksumType); h != nil && f.Checksum != "" {
+		in, err := os.Open(partial)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != strings.ToLower(f.Checksum) {
+			os.Remove(partial)
+			return errors.New("checksum mismatch")
+		}
+	}
+
+	storage := s.BoxHandler.StorageFor(s.Directory)
+	if fs, ok := storage.(*FileStorage); ok {
+		return os.Rename(partial, fs.Location(key))
+	}
+	in, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(key, in, info.Size()); err != nil {
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// download appends the rest of url, from offset, to out.
+func (s *Sync) download(out *os.File, url string, offset int64) error {
+	rangeHeader := ""
+	if offset > 0 {
+		rangeHeader = "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	}
+	resp, err := s.get(url, rangeHeader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Already complete.
+		return nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusOK:
+		// The server would not resume, so start again.
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	default:
+		return errors.New("download answered " + resp.Status)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// Run copies every missing box file, or with dryRun only reports them, and
+// returns the number of files that could not be copied.
+func (s *Sync) Run(dryRun bool) (int, error) {
+	missing, err := s.Missing()
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, f := range missing {
+		if dryRun {
+			fmt.Println("Would fetch " + f.String() + " from " + f.Url)
+			continue
+		}
+		logger.Info("Syncing box file", "file", f.String(), "url", f.Url)
+		if err := s.Fetch(f); err != nil {
+			logger.Error("Could not sync box file", "file", f.String(), "error", err)
+			failed++
+		}
+	}
+	if dryRun {
+		fmt.Println(strconv.Itoa(len(missing)) + " box files missing from " + s.Source)
+	} else {
+		logger.Info("Synced box files", "source", s.Source, "synced", len(missing)-failed, "missing", len(missing))
+	}
+	return failed, nil
+}
+
+// Schedule syncs every interval. Copied files are picked up by the watcher
+// of Directory.
+func (s *Sync) Schedule(interval time.Duration) {
+	for {
+		if _, err := s.Run(false); err != nil {
+			logger.Error("Could not sync", "source", s.Source, "error", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// syncCommand implements `vagrantshadow sync [-n] [-token=...]
+// [-constraint=...] <url> [user/box pattern...]`.
+func syncCommand(s *Sync, args []string) int {
+	dryRun := false
+	for _, arg := range args {
+		switch {
+		case arg == "-n" || arg == "-dry-run":
+			dryRun = true
+		case strings.HasPrefix(arg, "-token="):
+			s.Token = strings.TrimPrefix(arg, "-token=")
+		case strings.HasPrefix(arg, "-constraint="):
+			s.Constraint = strings.TrimPrefix(arg, "-constraint=")
+		case s.Source == "":
+			s.Source = arg
+		default:
+			s.Boxes = append(s.Boxes, arg)
+		}
+	}
+	if s.Source == "" {
+		logger.Error("Usage: vagrantshadow sync [-n] [-token=<token>] [-constraint=<constraint>] <url> [user/box pattern...]")
+		return 2
+	}
+	failed, err := s.Run(dryRun)
+	if err != nil {
+		logger.Error("Could not read the catalog", "source", s.Source, "error", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
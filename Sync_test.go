@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+// newTestSync serves a source directory from a server that, as with the
+// default settings, builds its URLs for localhost rather than the address it
+// is reached on.
+func newTestSync(t *testing.T) (*Sync, *BoxHandler, *httptest.Server, string, string) {
+	source, _ := ioutil.TempDir("", "vagrantshadow-sync-source")
+	target, _ := ioutil.TempDir("", "vagrantshadow-sync-target")
+	for _, name := range []string{
+		"acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box",
+		"acme-VAGRANTSLASH-ubuntu__2.0__virtualbox.box",
+		"acme-VAGRANTSLASH-ubuntu__2.0__vmware.box",
+		"other-VAGRANTSLASH-centos__1.0__virtualbox.box",
+	} {
+		ioutil.WriteFile(filepath.Join(source, name), []byte("contents of "+name), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(target, "acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box"), []byte("already here"), 0644)
+
+	host := "localhost"
+	port := 8099
+	remote := &BoxHandler{Hostname: host, Port: port}
+	m := mux.NewRouter()
+	m.Handle("/api/v1/search", searchHandler(remote)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(remote)).Methods("GET")
+	server := httptest.NewServer(m)
+	remote.PopulateBoxes([]string{source}, &port, &host)
+
+	local := &BoxHandler{Hostname: host, Port: port}
+	local.PopulateBoxes([]string{target}, &port, &host)
+	return &Sync{Source: server.URL, Directory: target, BoxHandler: local}, remote, server, source, target
+}
+
+func TestSyncFindsMissingBoxes(t *testing.T) {
+	assert := assert.New(t)
+	s, _, server, source, target := newTestSync(t)
+	defer server.Close()
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+
+	names := func() []string {
+		missing, err := s.Missing()
+		assert.Nil(err)
+		names := []string{}
+		for _, f := range missing {
+			names = append(names, f.String())
+		}
+		return names
+	}
+	assert.Equal([]string{"acme/ubuntu/2.0/virtualbox", "acme/ubuntu/2.0/vmware", "other/centos/1.0/virtualbox"}, names())
+	s.Boxes = []string{"acme/*"}
+	assert.Equal([]string{"acme/ubuntu/2.0/virtualbox", "acme/ubuntu/2.0/vmware"}, names())
+	s.Constraint = "< 2.0"
+	assert.Equal([]string{}, names())
+
+	s.Constraint = ""
+	failed, err := s.Run(true)
+	assert.Nil(err)
+	assert.Equal(0, failed)
+	_, err = os.Stat(filepath.Join(target, "acme-VAGRANTSLASH-ubuntu__2.0__vmware.box"))
+	assert.True(os.IsNotExist(err))
+
+	failed, err = s.Run(false)
+	assert.Nil(err)
+	assert.Equal(0, failed)
+	contents, _ := ioutil.ReadFile(filepath.Join(target, "acme-VAGRANTSLASH-ubuntu__2.0__vmware.box"))
+	assert.Equal("contents of acme-VAGRANTSLASH-ubuntu__2.0__vmware.box", string(contents))
+}
+
+func TestSyncResumesAndVerifiesDownloads(t *testing.T) {
+	assert := assert.New(t)
+	s, _, server, source, target := newTestSync(t)
+	defer server.Close()
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+
+	name := "other-VAGRANTSLASH-centos__1.0__virtualbox.box"
+	contents := "contents of " + name
+	sum := sha256.Sum256([]byte(contents))
+	f := SyncFile{Username: "other", Boxname: "centos", Version: "1.0", Provider: "virtualbox", Url: server.URL + "/other/centos/1.0/virtualbox/virtualbox.box", ChecksumType: "sha256", Checksum: "0000"}
+
+	assert.NotNil(s.Fetch(f))
+	_, err := os.Stat(filepath.Join(target, name))
+	assert.True(os.IsNotExist(err))
+
+	// A partial download from an earlier attempt is carried on with.
+	ioutil.WriteFile(filepath.Join(target, "."+name+".sync"), []byte(contents[:8]), 0644)
+	f.Checksum = hex.EncodeToString(sum[:])
+	assert.Nil(s.Fetch(f))
+	written, _ := ioutil.ReadFile(filepath.Join(target, name))
+	assert.Equal(contents, string(written))
+	_, err = os.Stat(filepath.Join(target, "."+name+".sync"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestSyncDownloadsFromTheSourceWithItsToken(t *testing.T) {
+	assert := assert.New(t)
+	s, remote, server, source, target := newTestSync(t)
+	defer server.Close()
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+	remote.Tokens = &TokenStore{Location: filepath.Join(source, "tokens.json")}
+	token, _ := remote.Tokens.Add("other", false, "sync")
+	remote.PrivateBoxes = []string{"other/*"}
+	remote.PopulateBoxes([]string{source}, &remote.Port, &remote.Hostname)
+	s.Token = token
+	s.Boxes = []string{"other/*"}
+
+	missing, err := s.Missing()
+	assert.Nil(err)
+	assert.Equal(1, len(missing))
+	assert.Equal(server.URL+"/other/centos/1.0/virtualbox/virtualbox.box", missing[0].Url)
+
+	failed, err := s.Run(false)
+	assert.Nil(err)
+	assert.Equal(0, failed)
+	contents, _ := ioutil.ReadFile(filepath.Join(target, "other-VAGRANTSLASH-centos__1.0__virtualbox.box"))
+	assert.Equal("contents of other-VAGRANTSLASH-centos__1.0__virtualbox.box", string(contents))
+}
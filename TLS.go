@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often the certificate files are checked
+// for changes.
+const certificateCheckInterval = 10 * time.Second
+
+// CertificateLoader serves a TLS certificate from a certificate and key file,
+// loading them again when either changes so that renewed certificates are
+// picked up without a restart.
+type CertificateLoader struct {
+	CertFile    string
+	KeyFile     string
+	certificate *tls.Certificate
+	modTimes    [2]time.Time
+	checked     time.Time
+	mutex       sync.Mutex
+}
+
+// Load reads the certificate and key.
+func (cl *CertificateLoader) Load() error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.load()
+}
+
+// load must be called with the mutex held.
+func (cl *CertificateLoader) load() error {
+	modTimes, err := cl.stat()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(cl.CertFile, cl.KeyFile)
+	if err != nil {
+		return err
+	}
+	cl.certificate = &certificate
+	cl.modTimes = modTimes
+	cl.checked = time.Now()
+	return nil
+}
+
+func (cl *CertificateLoader) stat() ([2]time.Time, error) {
+	modTimes := [2]time.Time{}
+	for i, location := range []string{cl.CertFile, cl.KeyFile} {
+		info, err := os.Stat(location)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If the files have
+// changed but cannot be loaded, such as while only one of them has been
+// replaced, the previous certificate is served.
+func (cl *CertificateLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if time.Since(cl.checked) < certificateCheckInterval && cl.certificate != nil {
+		return cl.certificate, nil
+	}
+	cl.checked = time.Now()
+	if modTimes, err := cl.stat(); err == nil && modTimes == cl.modTimes && cl.certificate != nil {
+		return cl.certificate, nil
+	}
+	if err := cl.load(); err != nil {
+		logger.Error("Could not reload certificate", "file", cl.CertFile, "error", err)
+		if cl.certificate == nil {
+			return nil, err
+		}
+		return cl.certificate, nil
+	}
+	logger.Info("Loaded certificate", "file", cl.CertFile)
+	return cl.certificate, nil
+}
+
+// redirectToHttps sends plain HTTP requests to the same path over HTTPS on
+// the given port.
+func redirectToHttps(port int) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// requestScheme is the scheme a request was made with.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func writeTestCertificate(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func certificateName(t *testing.T, cl *CertificateLoader) string {
+	certificate, err := cl.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := x509.ParseCertificate(certificate.Certificate[0])
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateIsReloadedWhenChanged(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-tls")
+	defer os.RemoveAll(dir)
+	writeTestCertificate(t, dir, "first")
+	cl := &CertificateLoader{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	assert.Nil(cl.Load())
+	assert.Equal("first", certificateName(t, cl))
+
+	writeTestCertificate(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cl.CertFile, later, later)
+	assert.Equal("first", certificateName(t, cl))
+	cl.checked = time.Time{}
+	assert.Equal("second", certificateName(t, cl))
+
+	ioutil.WriteFile(cl.KeyFile, []byte("half written"), 0600)
+	os.Chtimes(cl.KeyFile, later.Add(time.Minute), later.Add(time.Minute))
+	cl.checked = time.Time{}
+	assert.Equal("second", certificateName(t, cl))
+}
+
+func TestHttpIsRedirectedToHttps(t *testing.T) {
+	assert := assert.New(t)
+	w := doRequest(redirectToHttps(8443), "GET", "http://boxes.example.com:8080/benphegan/dev?access_token=x", "")
+	assert.Equal(301, w.Code)
+	assert.Equal("https://boxes.example.com:8443/benphegan/dev?access_token=x", w.Header().Get("Location"))
+	w = doRequest(redirectToHttps(443), "GET", "http://boxes.example.com/benphegan/dev", "")
+	assert.Equal("https://boxes.example.com/benphegan/dev", w.Header().Get("Location"))
+}
+
+func TestUrlsUseConfiguredScheme(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	bh.Scheme = "https"
+	bh.PopulateBoxes([]string{dir}, &bh.Port, &bh.Hostname)
+	version := bh.GetBox("benphegan", "dev").CurrentVersion
+	assert.Equal("https://localhost:8099/benphegan/dev/1.0/virtualbox/virtualbox.box", version.Providers[0].DownloadUrl)
+	assert.Equal("https://localhost:8099/api/v1/box/benphegan/dev/version/1.0/release", version.ReleaseUrl)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// TokenStore is the local file of access tokens allowed to see private boxes
+// and to publish through the API. Only a hash of each token is kept, and the
+// file is re-read whenever it changes so tokens can be managed with the
+// `vagrantshadow token` command while the server is running.
+type TokenStore struct {
+	Location string
+	Tokens   []AccessToken
+	modTime  time.Time
+	mutex    sync.Mutex
+}
+
+type AccessToken struct {
+	Hash string `json:"token_sha256"`
+	// Username is the owner whose boxes the token can see and publish.
+	Username    string `json:"username"`
+	Admin       bool   `json:"admin"`
+	Description string `json:"description"`
+	Created     string `json:"created_at"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CanAccess reports whether the token covers boxes owned by username.
+func (t AccessToken) CanAccess(username string) bool {
+	return t.Admin || t.Username == username
+}
+
+// Load reads the token file, which may not exist yet.
+func (ts *TokenStore) Load() error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.load()
+}
+
+// load must be called with the mutex held.
+func (ts *TokenStore) load() error {
+	ts.Tokens = nil
+	info, err := os.Stat(ts.Location)
+	if os.IsNotExist(err) {
+		ts.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(ts.Location)
+	if err != nil {
+		return err
+	}
+	ts.modTime = info.ModTime()
+	return json.Unmarshal(data, &ts.Tokens)
+}
+
+// refresh reloads the token file if it has changed since it was last read.
+// Must be called with the mutex held.
+func (ts *TokenStore) refresh() {
+	info, err := os.Stat(ts.Location)
+	if err == nil && info.ModTime().Equal(ts.modTime) || os.IsNotExist(err) && ts.modTime.IsZero() {
+		return
+	}
+	if err := ts.load(); err != nil {
+		logger.Error("Could not read token store", "file", ts.Location, "error", err)
+	}
+}
+
+// save must be called with the mutex held.
+func (ts *TokenStore) save() error {
+	data, err := json.MarshalIndent(ts.Tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ts.Location), 0755); err != nil {
+		return err
+	}
+	tmp := ts.Location + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.Location)
+}
+
+// Add creates a new token, returning it. The token itself is not stored and
+// cannot be shown again.
+func (ts *TokenStore) Add(username string, admin bool, description string) (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if err := ts.load(); err != nil {
+		return "", err
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	ts.Tokens = append(ts.Tokens, AccessToken{
+		Hash:        hashToken(token),
+		Username:    username,
+		Admin:       admin,
+		Description: description,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+	})
+	return token, ts.save()
+}
+
+// Remove deletes the tokens whose hash starts with prefix, returning how
+// many were removed.
+func (ts *TokenStore) Remove(prefix string) (int, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if err := ts.load(); err != nil {
+		return 0, err
+	}
+	kept := []AccessToken{}
+	for _, t := range ts.Tokens {
+		if prefix == "" || !strings.HasPrefix(t.Hash, prefix) {
+			kept = append(kept, t)
+		}
+	}
+	removed := len(ts.Tokens) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	ts.Tokens = kept
+	return removed, ts.save()
+}
+
+// Enabled reports whether any tokens are configured.
+func (ts *TokenStore) Enabled() bool {
+	if ts == nil {
+		return false
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.refresh()
+	return len(ts.Tokens) > 0
+}
+
+// Lookup finds the stored token matching a token presented by a client.
+func (ts *TokenStore) Lookup(token string) (AccessToken, bool) {
+	if ts == nil || token == "" {
+		return AccessToken{}, false
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.refresh()
+	hash := []byte(hashToken(token))
+	for _, t := range ts.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return AccessToken{}, false
+}
+
+// requestToken returns the token a client sent, either as the bearer token
+// Vagrant sets from VAGRANT_CLOUD_TOKEN or as the access_token parameter
+// older versions of Vagrant add to URLs.
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// authorizeBox checks that the caller may see a box, answering the request
+// and returning false if not. Callers without a token, or whose token does
+// not cover the box, are told it does not exist.
+func authorizeBox(bh *BoxHandler, w http.ResponseWriter, r *http.Request, box Box) bool {
+	if !box.Private {
+		return true
+	}
+	token := requestToken(r)
+	if token == "" {
+		writeJsonError(w, http.StatusNotFound, "Resource not found!")
+		return false
+	}
+	t, ok := bh.Tokens.Lookup(token)
+	if !ok {
+		writeJsonError(w, http.StatusUnauthorized, "Invalid access token")
+		return false
+	}
+	if !t.CanAccess(box.Username) {
+		writeJsonError(w, http.StatusNotFound, "Resource not found!")
+		return false
+	}
+	return true
+}
+
+// requireToken guards the publishing API. The token must cover the {user} of
+// the route, if it has one. Without any tokens publishing is refused, unless
+// the BoxHandler leaves it open.
+func requireToken(bh *BoxHandler, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !bh.Tokens.Enabled() {
+			if bh.OpenPublish {
+				h.ServeHTTP(w, r)
+				return
+			}
+			logger.Info("Rejected publishing request, no tokens exist", "path", r.URL.Path)
+			writeJsonError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if _, ok := bh.Tokens.Lookup(requestToken(r)); !ok {
+			logger.Info("Rejected unauthenticated request", "path", r.URL.Path)
+			writeJsonError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if user, ok := mux.Vars(r)["user"]; ok && !canPublish(bh, r, user) {
+			writeJsonError(w, http.StatusForbidden, "Token cannot publish boxes for "+user)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// hasAccess reports whether the caller presented a token covering boxes
+// owned by username.
+func hasAccess(bh *BoxHandler, r *http.Request, username string) bool {
+	t, ok := bh.Tokens.Lookup(requestToken(r))
+	return ok && t.CanAccess(username)
+}
+
+// canPublish reports whether the caller may publish boxes for username.
+func canPublish(bh *BoxHandler, r *http.Request, username string) bool {
+	if !bh.Tokens.Enabled() {
+		return bh.OpenPublish
+	}
+	return hasAccess(bh, r, username)
+}
+
+// isPrivateBox reports whether user/box matches one of the configured
+// private box patterns, such as "benphegan/*".
+func isPrivateBox(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenCommand implements `vagrantshadow token add|list|remove`.
+func tokenCommand(location string, args []string) int {
+	ts := TokenStore{Location: location}
+	if len(args) == 0 {
+		logger.Error("Usage: vagrantshadow [-k tokenfile] token add <username>|list|remove <hash prefix>")
+		return 2
+	}
+	switch args[0] {
+	case "add":
+		admin := false
+		username := ""
+		description := ""
+		for _, arg := range args[1:] {
+			switch {
+			case arg == "-admin":
+				admin = true
+			case strings.HasPrefix(arg, "-description="):
+				description = strings.TrimPrefix(arg, "-description=")
+			default:
+				username = arg
+			}
+		}
+		if username == "" && !admin {
+			logger.Error("A username, or -admin, is required")
+			return 2
+		}
+		token, err := ts.Add(username, admin, description)
+		if err != nil {
+			logger.Error("Could not add token", "error", err)
+			return 1
+		}
+		fmt.Println(token)
+	case "list":
+		if err := ts.Load(); err != nil {
+			logger.Error("Could not read token store", "error", err)
+			return 1
+		}
+		for _, t := range ts.Tokens {
+			scope := t.Username
+			if t.Admin {
+				scope = "admin"
+			}
+			fmt.Println(t.Hash[:12] + "\t" + scope + "\t" + t.Created + "\t" + t.Description)
+		}
+	case "remove":
+		if len(args) < 2 || args[1] == "" {
+			logger.Error("A token hash prefix, as shown by list, is required")
+			return 2
+		}
+		removed, err := ts.Remove(args[1])
+		if err != nil {
+			logger.Error("Could not remove token", "error", err)
+			return 1
+		}
+		if removed == 0 {
+			logger.Error("No token matches", "prefix", args[1])
+			return 1
+		}
+	default:
+		logger.Error("Unknown token command", "command", args[0])
+		return 2
+	}
+	return 0
+}
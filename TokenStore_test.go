@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func newPrivateBoxHandler(t *testing.T) (*BoxHandler, *mux.Router, string) {
+	dir, err := ioutil.TempDir("", "vagrantshadow-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-secret__1.0__virtualbox.box"), []byte("box contents"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-secret.yaml"), []byte("private: true\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "acme-VAGRANTSLASH-internal__1.0__virtualbox.box"), []byte("box contents"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "acme-VAGRANTSLASH-public__1.0__virtualbox.box"), []byte("box contents"), 0644)
+
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, PrivateBoxes: []string{"acme/int*"}}
+	bh.Tokens = &TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+
+	m := mux.NewRouter()
+	m.Handle("/api/v1/box/{user}/{boxname}", requireToken(bh, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).Methods("PUT")
+	m.Handle("/{user}/{boxname}", getBox(bh, host)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	return bh, m, dir
+}
+
+func doTokenRequest(m http.Handler, method string, url string, token string) int {
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestPrivateBoxesNeedAToken(t *testing.T) {
+	assert := assert.New(t)
+	bh, m, dir := newPrivateBoxHandler(t)
+	defer os.RemoveAll(dir)
+	ben, _ := bh.Tokens.Add("benphegan", false, "")
+	acme, _ := bh.Tokens.Add("acme", false, "")
+
+	assert.True(bh.GetBox("benphegan", "secret").Private)
+	assert.True(bh.GetBox("acme", "internal").Private)
+	assert.False(bh.GetBox("acme", "public").Private)
+	assert.Equal(1, len(bh.PublicBoxes()))
+
+	assert.Equal(http.StatusNotFound, doTokenRequest(m, "GET", "/benphegan/secret", ""))
+	assert.Equal(http.StatusUnauthorized, doTokenRequest(m, "GET", "/benphegan/secret", "nonsense"))
+	assert.Equal(http.StatusNotFound, doTokenRequest(m, "GET", "/benphegan/secret", acme))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "GET", "/benphegan/secret", ben))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "GET", "/benphegan/secret?access_token="+ben, ""))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "GET", "/acme/public", ""))
+
+	assert.Equal(http.StatusNotFound, doTokenRequest(m, "GET", "/acme/internal/1.0/virtualbox/virtualbox.box", ""))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "GET", "/acme/internal/1.0/virtualbox/virtualbox.box", acme))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "GET", "/acme/internal/1.0/virtualbox/virtualbox.box?access_token="+acme, ""))
+}
+
+func TestPublishingNeedsAToken(t *testing.T) {
+	assert := assert.New(t)
+	bh, m, dir := newPrivateBoxHandler(t)
+	defer os.RemoveAll(dir)
+
+	assert.Equal(http.StatusUnauthorized, doTokenRequest(m, "PUT", "/api/v1/box/acme/public", ""))
+	bh.OpenPublish = true
+	assert.Equal(http.StatusOK, doTokenRequest(m, "PUT", "/api/v1/box/acme/public", ""))
+
+	acme, _ := bh.Tokens.Add("acme", false, "")
+	admin, _ := bh.Tokens.Add("", true, "")
+	assert.Equal(http.StatusUnauthorized, doTokenRequest(m, "PUT", "/api/v1/box/acme/public", ""))
+	assert.Equal(http.StatusForbidden, doTokenRequest(m, "PUT", "/api/v1/box/benphegan/secret", acme))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "PUT", "/api/v1/box/acme/public", acme))
+	assert.Equal(http.StatusOK, doTokenRequest(m, "PUT", "/api/v1/box/benphegan/secret", admin))
+}
+
+func TestTokenStoreOnlyKeepsHashes(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vagrantshadow-tokens")
+	defer os.RemoveAll(dir)
+	ts := TokenStore{Location: filepath.Join(dir, "tokens.json")}
+	token, err := ts.Add("benphegan", false, "laptop")
+	assert.Nil(err)
+
+	data, _ := ioutil.ReadFile(ts.Location)
+	assert.NotContains(string(data), token)
+
+	reloaded := TokenStore{Location: ts.Location}
+	found, ok := reloaded.Lookup(token)
+	assert.True(ok)
+	assert.Equal("benphegan", found.Username)
+
+	removed, err := reloaded.Remove(found.Hash[:12])
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	_, ok = ts.Lookup(token)
+	assert.False(ok)
+}
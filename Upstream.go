@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUpstreamNotFound is returned when the upstream does not have a box.
+var ErrUpstreamNotFound = errors.New("not found upstream")
+
+// errTooBigToCache stops caching a box that turns out to be bigger than the
+// upstream cache.
+var errTooBigToCache = errors.New("bigger than the upstream cache")
+
+// Upstream serves boxes that are not found locally from another Vagrant
+// Cloud compatible server, such as https://vagrantcloud.com. Metadata is
+// fetched on demand and its URLs pointed back at this server, and each box
+// file is cached in Directory as it is first downloaded, where the indexer
+// serves it like any other box. The least recently used boxes are removed
+// once the cache grows past MaxSize bytes.
+type Upstream struct {
+	Url        string
+	Directory  string
+	MaxSize    int64
+	BoxHandler *BoxHandler
+	Refresh    func()
+	Client     *http.Client
+	// Storage is where boxes are cached, the storage of Directory if not set.
+	Storage Storage
+	// MetadataTTL is how long fetched metadata, or the upstream not having a
+	// box, is answered from memory.
+	MetadataTTL time.Duration
+	metadata    map[string]upstreamMetadata
+	lastUsed    map[string]time.Time
+	fetching    map[string]bool
+	mutex       sync.Mutex
+}
+
+type upstreamMetadata struct {
+	Box      Box
+	NotFound bool
+	Fetched  time.Time
+}
+
+// upstreamBox is the metadata Vagrant Cloud answers box lookups with.
+type upstreamBox struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Versions    []struct {
+		Version     string     `json:"version"`
+		Status      string     `json:"status"`
+		Description string     `json:"description"`
+		Providers   []Provider `json:"providers"`
+	} `json:"versions"`
+}
+
+func (u *Upstream) client() *http.Client {
+	if u.Client != nil {
+		return u.Client
+	}
+	return http.DefaultClient
+}
+
+func (u *Upstream) storage() Storage {
+	if u.Storage != nil {
+		return u.Storage
+	}
+	return u.BoxHandler.StorageFor(u.Directory)
+}
+
+func (u *Upstream) refresh() {
+	if u.Refresh != nil {
+		u.Refresh()
+	}
+}
+
+// Owns reports whether every file of a box came from the upstream cache, so
+// the upstream, rather than the files that happen to be cached, has the
+// final say on its versions.
+func (u *Upstream) Owns(box Box) bool {
+	if u == nil {
+		return false
+	}
+	owned := false
+	for _, v := range box.Versions {
+		for _, p := range v.Providers {
+			if !u.Cached(p) {
+				return false
+			}
+			owned = true
+		}
+	}
+	return owned
+}
+
+// Cached reports whether a box file is in the upstream cache.
+func (u *Upstream) Cached(p Provider) bool {
+	if u == nil {
+		return false
+	}
+	return strings.HasPrefix(p.LocalBoxFile, absoluteDirectory(u.Directory)+string(filepath.Separator))
+}
+
+// Box returns the upstream metadata for a box with its download URLs
+// pointing at this server. Names that are not valid box names are never
+// looked up.
+func (u *Upstream) Box(user string, boxName string) (Box, error) {
+	if !validBoxName.MatchString(user) || !validBoxName.MatchString(boxName) {
+		return Box{}, ErrUpstreamNotFound
+	}
+	key := user + "/" + boxName
+	u.mutex.Lock()
+	cached, ok := u.metadata[key]
+	u.mutex.Unlock()
+	if ok && time.Since(cached.Fetched) < u.MetadataTTL {
+		if cached.NotFound {
+			return Box{}, ErrUpstreamNotFound
+		}
+		return cached.Box.ServedVersions(false), nil
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(u.Url, "/")+"/"+user+"/"+boxName, nil)
+	if err != nil {
+		return Box{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return Box{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		u.remember(key, upstreamMetadata{NotFound: true, Fetched: time.Now()})
+		return Box{}, ErrUpstreamNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Box{}, errors.New("upstream answered " + resp.Status)
+	}
+	var ub upstreamBox
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&ub); err != nil {
+		return Box{}, err
+	}
+
+	base := u.BoxHandler.BaseUrl()
+	box := Box{Name: key, Tag: key, Username: user, ShortDescription: ub.Description, DescriptionMarkdown: ub.Description}
+	for _, uv := range ub.Versions {
+		if !validBoxVersion.MatchString(uv.Version) {
+			continue
+		}
+		version := Version{Version: uv.Version, Status: uv.Status, DescriptionMarkdown: uv.Description}
+		if version.Status == "" {
+			version.Status = VersionActive
+		}
+		for _, p := range uv.Providers {
+			if !validBoxName.MatchString(p.Name) {
+				continue
+			}
+			p.OriginalUrl = p.Url
+			if p.OriginalUrl == "" {
+				p.OriginalUrl = p.DownloadUrl
+			}
+			if p.Architecture != "" && !validBoxName.MatchString(p.Architecture) {
+				continue
+			}
+			p.DownloadUrl = providerUrl(base, user, boxName, uv.Version, p.Name, p.Architecture)
+			p.Url = p.DownloadUrl
+			p.UploadUrl = ""
+			version.Providers = append(version.Providers, p)
+		}
+		box.Versions = append(box.Versions, version)
+	}
+	sortVersions(&box)
+	box.CurrentVersion = currentVersion(box.Versions)
+
+	u.remember(key, upstreamMetadata{Box: box, Fetched: time.Now()})
+	return box.ServedVersions(false), nil
+}
+
+func (u *Upstream) remember(key string, metadata upstreamMetadata) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.metadata == nil {
+		u.metadata = make(map[string]upstreamMetadata)
+	}
+	u.metadata[key] = metadata
+}
+
+// provider finds where the upstream keeps a box file, fetching the metadata
+// again if it has not been seen since the server started.
+func (u *Upstream) provider(user string, boxName string, version string, provider string, architecture string) (Provider, error) {
+	u.mutex.Lock()
+	cached, ok := u.metadata[user+"/"+boxName]
+	u.mutex.Unlock()
+	box := cached.Box
+	if !ok || cached.NotFound {
+		var err error
+		if box, err = u.Box(user, boxName); err != nil {
+			return Provider{}, err
+		}
+	}
+	for _, v := range box.Versions {
+		if v.Version == version && v.Status == VersionActive {
+			if p, ok := findProvider(v.Providers, provider, architecture); ok && p.OriginalUrl != "" {
+				return p, nil
+			}
+		}
+	}
+	return Provider{}, ErrUpstreamNotFound
+}
+
+// Download streams a box file from the upstream, caching it on the way
+// through. Resumed downloads, boxes bigger than the cache and boxes already
+// being cached by another request are passed through without being cached.
+// Boxes sent without a length stop being cached once they outgrow the cache.
+func (u *Upstream) Download(w http.ResponseWriter, r *http.Request, user string, boxName string, version string, provider string, architecture string) {
+	p, err := u.provider(user, boxName, version, provider, architecture)
+	if err == ErrUpstreamNotFound {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.Warn("Could not look up box upstream", "box", user+"/"+boxName, "error", err)
+		writeJsonError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+	req, err := http.NewRequest("GET", p.OriginalUrl, nil)
+	if err != nil {
+		logger.Warn("Invalid upstream URL", "url", p.OriginalUrl, "error", err)
+		writeJsonError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := u.client().Do(req)
+	if err != nil {
+		logger.Warn("Could not download from upstream", "url", p.OriginalUrl, "error", err)
+		writeJsonError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		notFound(w, r)
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		logger.Warn("Could not download from upstream", "url", p.OriginalUrl, "status", resp.Status)
+		writeJsonError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+
+	for _, header := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(resp.StatusCode)
+
+	key, ok := u.BoxHandler.BoxKey(u.Directory, user, boxName, version, provider, p.Architecture)
+	if !ok || resp.StatusCode != http.StatusOK || resp.ContentLength > u.MaxSize || !u.startFetching(key) {
+		io.Copy(w, resp.Body)
+		return
+	}
+	defer u.stopFetching(key)
+
+	logger.Info("Caching upstream box", "url", p.OriginalUrl, "key", key)
+	body := io.Reader(resp.Body)
+	if checksum := newChecksumReader(resp.Body, p.ChecksumType, p.Checksum); checksum != nil {
+		body = checksum
+	}
+	body = &sizeLimitReader{LimitedReader: io.LimitedReader{R: body, N: u.MaxSize + 1}}
+	// The box is still cached if the client goes away part way through, and
+	// the client still gets all of it if it cannot be cached.
+	cw := &clientWriter{w: w}
+	err = u.storage().Put(key, io.TeeReader(body, cw), resp.ContentLength)
+	if err != nil {
+		if err == errTooBigToCache {
+			logger.Info("Not caching upstream box bigger than the cache", "url", p.OriginalUrl, "max_size", u.MaxSize)
+		} else {
+			logger.Warn("Could not cache upstream box", "url", p.OriginalUrl, "error", err)
+		}
+		io.Copy(cw, resp.Body)
+		return
+	}
+	u.Used(key)
+	u.Evict(key)
+	u.refresh()
+}
+
+func (u *Upstream) startFetching(key string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.fetching == nil {
+		u.fetching = make(map[string]bool)
+	}
+	if u.fetching[key] {
+		return false
+	}
+	u.fetching[key] = true
+	return true
+}
+
+func (u *Upstream) stopFetching(key string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.fetching, key)
+}
+
+// Used marks a cached box as just used. Boxes not used since the server
+// started are ordered by when they were cached.
+func (u *Upstream) Used(key string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.lastUsed == nil {
+		u.lastUsed = make(map[string]time.Time)
+	}
+	u.lastUsed[key] = time.Now()
+}
+
+// UsedFile marks a cached box as just used given its location on disk, and
+// ignores boxes that are not in the cache.
+func (u *Upstream) UsedFile(location string) {
+	if u == nil {
+		return
+	}
+	if key, err := filepath.Rel(absoluteDirectory(u.Directory), location); err == nil && !strings.HasPrefix(key, "..") {
+		u.Used(filepath.ToSlash(key))
+	}
+}
+
+// Evict removes the least recently used boxes until the cache fits in
+// MaxSize, keeping the box given. The catalog is left to be refreshed.
+func (u *Upstream) Evict(keep string) {
+	objects, err := u.storage().List(u.BoxHandler.IsTreeDirectory(u.Directory))
+	if err != nil {
+		logger.Warn("Could not list upstream cache", "directory", u.Directory, "error", err)
+		return
+	}
+	boxes := []StorageObject{}
+	var total int64
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, ".box") && !strings.HasPrefix(path.Base(o.Key), ".") {
+			boxes = append(boxes, o)
+			total += o.Size
+		}
+	}
+	u.mutex.Lock()
+	lastUsed := func(o StorageObject) time.Time {
+		if t, ok := u.lastUsed[o.Key]; ok {
+			return t
+		}
+		return o.ModTime
+	}
+	sort.Slice(boxes, func(i, j int) bool { return lastUsed(boxes[i]).Before(lastUsed(boxes[j])) })
+	u.mutex.Unlock()
+
+	for _, o := range boxes {
+		if total <= u.MaxSize {
+			break
+		}
+		if o.Key == keep {
+			continue
+		}
+		logger.Info("Evicting from the upstream cache", "key", o.Key, "bytes", o.Size)
+		if err := os.Remove(u.storage().Location(o.Key)); err != nil {
+			logger.Warn("Could not evict from the upstream cache", "key", o.Key, "error", err)
+			continue
+		}
+		u.mutex.Lock()
+		delete(u.lastUsed, o.Key)
+		u.mutex.Unlock()
+		total -= o.Size
+	}
+}
+
+// sizeLimitReader fails once more than N-1 bytes have been read.
+type sizeLimitReader struct {
+	io.LimitedReader
+}
+
+func (sr *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := sr.LimitedReader.Read(p)
+	if sr.N <= 0 {
+		return n, errTooBigToCache
+	}
+	return n, err
+}
+
+// clientWriter passes writes on to a client until the first one fails, and
+// then quietly drops the rest.
+type clientWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if !cw.failed {
+		if _, err := cw.w.Write(p); err != nil {
+			cw.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// checksumReader fails the read that reaches the end of a box whose
+// checksum does not match, so a corrupt download is never cached.
+type checksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// newChecksumReader returns nil for checksum types it does not know.
+func newChecksumReader(r io.Reader, checksumType string, checksum string) *checksumReader {
+	h := newChecksumHash(checksumType)
+	if h == nil || checksum == "" {
+		return nil
+	}
+	return &checksumReader{r: r, hash: h, expected: strings.ToLower(checksum)}
+}
+
+// newChecksumHash returns the hash for a Vagrant checksum type, or nil for
+// types it does not know.
+func newChecksumHash(checksumType string) hash.Hash {
+	switch strings.ToLower(checksumType) {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(cr.hash.Sum(nil)) != cr.expected {
+		return n, errors.New("checksum mismatch")
+	}
+	return n, err
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+// fakeUpstream serves Vagrant Cloud style metadata for acme/<box> boxes,
+// each with a single virtualbox provider, and counts metadata lookups and
+// box file downloads.
+type fakeUpstream struct {
+	Server    *httptest.Server
+	Files     map[string]string
+	Checksums map[string]string
+	Lookups   map[string]int
+	Downloads map[string]int
+	// Chunked sends box files without a Content-Length.
+	Chunked bool
+	mutex   sync.Mutex
+}
+
+func newFakeUpstream() *fakeUpstream {
+	f := &fakeUpstream{Files: make(map[string]string), Checksums: make(map[string]string), Lookups: make(map[string]int), Downloads: make(map[string]int)}
+	m := mux.NewRouter()
+	m.HandleFunc("/acme/{boxname}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["boxname"]
+		f.mutex.Lock()
+		f.Lookups[name]++
+		f.mutex.Unlock()
+		contents, ok := f.Files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		checksum := f.Checksums[name]
+		if checksum == "" {
+			sum := sha256.Sum256([]byte(contents))
+			checksum = hex.EncodeToString(sum[:])
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"name":        "acme/" + name,
+			"description": "Upstream " + name,
+			"versions": []map[string]interface{}{{
+				"version": "1.0",
+				"providers": []map[string]string{{
+					"name":          "virtualbox",
+					"url":           f.Server.URL + "/files/" + name + ".box",
+					"checksum_type": "sha256",
+					"checksum":      checksum,
+				}},
+			}},
+		})
+	})
+	m.HandleFunc("/files/{boxname}.box", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["boxname"]
+		f.mutex.Lock()
+		f.Downloads[name]++
+		f.mutex.Unlock()
+		if f.Chunked {
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(f.Files[name]))
+	})
+	f.Server = httptest.NewServer(m)
+	return f
+}
+
+func newTestUpstream(t *testing.T, f *fakeUpstream, maxSize int64) (*BoxHandler, *mux.Router, string) {
+	dir, err := ioutil.TempDir("", "vagrantshadow-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port}
+	bh.Upstream = &Upstream{
+		Url:        f.Server.URL,
+		Directory:  dir,
+		MaxSize:    maxSize,
+		BoxHandler: bh,
+		Refresh:    func() { bh.PopulateBoxes([]string{dir}, &port, &host) },
+	}
+	bh.Upstream.Refresh()
+
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, host)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	return bh, m, dir
+}
+
+func TestUpstreamBoxesAreFetchedAndCached(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	f.Files["ubuntu"] = "ubuntu box"
+	bh, m, dir := newTestUpstream(t, f, 1<<20)
+	defer os.RemoveAll(dir)
+
+	w := doRequest(m, "GET", "/acme/ubuntu", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var box Box
+	json.Unmarshal(w.Body.Bytes(), &box)
+	assert.Equal("acme/ubuntu", box.Name)
+	assert.Equal("1.0", box.CurrentVersion.Version)
+	assert.Equal("http://localhost:8099/acme/ubuntu/1.0/virtualbox/virtualbox.box", box.CurrentVersion.Providers[0].Url)
+
+	w = doRequest(m, "GET", "/acme/ubuntu/1.0/virtualbox/virtualbox.box", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ubuntu box", w.Body.String())
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box"))
+	assert.Nil(err)
+	assert.Equal("ubuntu box", string(contents))
+	assert.True(bh.BoxAvailable("acme", "ubuntu"))
+
+	w = doRequest(m, "GET", "/acme/ubuntu/1.0/virtualbox/virtualbox.box", "")
+	assert.Equal("ubuntu box", w.Body.String())
+	assert.Equal(1, f.Downloads["ubuntu"])
+
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/acme/missing", "").Code)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/acme/ubuntu/2.0/virtualbox/virtualbox.box", "").Code)
+
+	// Cached boxes are still served when the upstream goes away.
+	f.Server.Close()
+	bh.Upstream.MetadataTTL = 0
+	w = doRequest(m, "GET", "/acme/ubuntu", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/acme/ubuntu/1.0/virtualbox/virtualbox.box", "").Code)
+	assert.Equal(http.StatusBadGateway, doRequest(m, "GET", "/acme/other", "").Code)
+}
+
+func TestUpstreamLookupsAreLimitedToValidNames(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	bh, m, dir := newTestUpstream(t, f, 1<<20)
+	defer os.RemoveAll(dir)
+	bh.Upstream.MetadataTTL = time.Minute
+
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/acme/missing", "").Code)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/acme/missing", "").Code)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/acme/missing/1.0/virtualbox/virtualbox.box", "").Code)
+	assert.Equal(1, f.Lookups["missing"])
+
+	_, err := bh.Upstream.Box("acme", "..")
+	assert.Equal(ErrUpstreamNotFound, err)
+	_, err = bh.Upstream.Box("acme", "ubuntu?x=1")
+	assert.Equal(ErrUpstreamNotFound, err)
+	assert.Equal(1, len(f.Lookups))
+}
+
+func TestUpstreamBoxesWithBadChecksumsAreNotCached(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	f.Files["ubuntu"] = "ubuntu box"
+	f.Checksums["ubuntu"] = "0000"
+	bh, m, dir := newTestUpstream(t, f, 1<<20)
+	defer os.RemoveAll(dir)
+
+	doRequest(m, "GET", "/acme/ubuntu/1.0/virtualbox/virtualbox.box", "")
+	_, err := os.Stat(filepath.Join(dir, "acme-VAGRANTSLASH-ubuntu__1.0__virtualbox.box"))
+	assert.True(os.IsNotExist(err))
+	assert.False(bh.BoxAvailable("acme", "ubuntu"))
+}
+
+func TestUpstreamCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	f.Files["one"] = "first box"
+	f.Files["two"] = "second box"
+	f.Files["three"] = "third box"
+	bh, m, dir := newTestUpstream(t, f, 20)
+	defer os.RemoveAll(dir)
+
+	doRequest(m, "GET", "/acme/one/1.0/virtualbox/virtualbox.box", "")
+	doRequest(m, "GET", "/acme/two/1.0/virtualbox/virtualbox.box", "")
+	doRequest(m, "GET", "/acme/one/1.0/virtualbox/virtualbox.box", "")
+	doRequest(m, "GET", "/acme/three/1.0/virtualbox/virtualbox.box", "")
+
+	assert.True(bh.BoxAvailable("acme", "one"))
+	assert.False(bh.BoxAvailable("acme", "two"))
+	assert.True(bh.BoxAvailable("acme", "three"))
+	assert.Equal(1, f.Downloads["one"])
+}
+
+func TestUpstreamBoxesWithoutALengthAreLimitedToTheCacheSize(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	f.Chunked = true
+	f.Files["small"] = "small box"
+	f.Files["large"] = "a box that will not fit"
+	bh, m, dir := newTestUpstream(t, f, 10)
+	defer os.RemoveAll(dir)
+
+	w := doRequest(m, "GET", "/acme/large/1.0/virtualbox/virtualbox.box", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("a box that will not fit", w.Body.String())
+	assert.False(bh.BoxAvailable("acme", "large"))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(0, len(files))
+
+	w = doRequest(m, "GET", "/acme/small/1.0/virtualbox/virtualbox.box", "")
+	assert.Equal("small box", w.Body.String())
+	assert.True(bh.BoxAvailable("acme", "small"))
+}
+
+// failingStorage fails every Put after reading part of the object.
+type failingStorage struct {
+	*FileStorage
+}
+
+func (fs failingStorage) Put(key string, r io.Reader, size int64) error {
+	io.CopyN(ioutil.Discard, r, 4)
+	return errors.New("no space left on device")
+}
+
+func TestUpstreamBoxesAreStillServedWhenCachingFails(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeUpstream()
+	defer f.Server.Close()
+	f.Files["ubuntu"] = "ubuntu box"
+	bh, m, dir := newTestUpstream(t, f, 1<<20)
+	defer os.RemoveAll(dir)
+	bh.Upstream.Storage = failingStorage{&FileStorage{Root: dir}}
+
+	w := doRequest(m, "GET", "/acme/ubuntu/1.0/virtualbox/virtualbox.box", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ubuntu box", w.Body.String())
+	assert.False(bh.BoxAvailable("acme", "ubuntu"))
+}
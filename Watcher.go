@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/go-fsnotify/fsnotify"
+)
+
+// Watcher passes changes in the box directories to a Reindexer. Local
+// directories are watched with fsnotify, tree directories recursively.
+// Directories that fsnotify cannot watch, that are asked to be polled (such
+// as NFS or SMB mounts, where inotify never fires) or that are not local are
+// listed every PollInterval instead. Watch errors are logged and answered
+// with a full reindex rather than stopping the server.
+type Watcher struct {
+	BoxHandler   *BoxHandler
+	Reindexer    *Reindexer
+	PollInterval time.Duration
+	watcher      *fsnotify.Watcher
+	watched      []watchedDirectory
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+type watchedDirectory struct {
+	Directory string
+	Tree      bool
+}
+
+// Watch starts following changes to a directory.
+func (w *Watcher) Watch(directory string, poll bool) {
+	tree := w.BoxHandler.IsTreeDirectory(directory)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done == nil {
+		w.done = make(chan struct{})
+	}
+	if poll || isRemoteDirectory(directory) {
+		w.poll(directory, tree, w.done)
+		return
+	}
+	if w.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logger.Warn("Could not create file watcher, polling instead", "directory", directory, "error", err)
+			w.poll(directory, tree, w.done)
+			return
+		}
+		w.watcher = watcher
+		go w.run(watcher)
+	}
+	if err := w.add(directory, tree); err != nil {
+		logger.Warn("Could not watch directory, polling it instead", "directory", directory, "error", err)
+		w.poll(directory, tree, w.done)
+		return
+	}
+	w.watched = append(w.watched, watchedDirectory{Directory: absoluteDirectory(directory), Tree: tree})
+}
+
+// Close stops watching and polling.
+func (w *Watcher) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+	if w.watcher != nil {
+		w.watcher.Close()
+		w.watcher = nil
+	}
+}
+
+// add watches a directory, along with all of its subdirectories when tree is
+// set. Must be called with the mutex held.
+func (w *Watcher) add(directory string, tree bool) error {
+	if !tree {
+		logger.Info("Setting directory watch", "directory", directory)
+		return w.watcher.Add(directory)
+	}
+	return filepath.Walk(directory, func(location string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		logger.Debug("Setting directory watch", "directory", location)
+		return w.watcher.Add(location)
+	})
+}
+
+func (w *Watcher) run(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				w.fallBackToPolling(watcher)
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				w.fallBackToPolling(watcher)
+				return
+			}
+			// Events may have been lost, so look at everything again.
+			logger.Warn("File watcher error, reindexing", "error", err)
+			w.Reindexer.RescanAll()
+		}
+	}
+}
+
+func (w *Watcher) handle(ev fsnotify.Event) {
+	location := absoluteDirectory(ev.Name)
+	logger.Debug("Change detected", "file", location)
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(location); err == nil && info.IsDir() {
+			w.mutex.Lock()
+			for _, d := range w.watched {
+				if d.Tree && strings.HasPrefix(location, d.Directory+string(filepath.Separator)) {
+					if err := w.add(location, true); err != nil {
+						logger.Warn("Could not watch directory", "directory", location, "error", err)
+					}
+					// Files may have landed before the watch was added.
+					w.Reindexer.RescanAll()
+				}
+			}
+			w.mutex.Unlock()
+			return
+		}
+	}
+	w.Reindexer.Changed(location, ev.Op&fsnotify.Write == fsnotify.Write)
+}
+
+// fallBackToPolling polls everything that was being watched if the watcher
+// stops without being closed.
+func (w *Watcher) fallBackToPolling(watcher *fsnotify.Watcher) {
+	w.mutex.Lock()
+	if w.watcher != watcher {
+		w.mutex.Unlock()
+		return
+	}
+	watched := w.watched
+	w.watched = nil
+	w.watcher = nil
+	logger.Warn("File watcher stopped, polling instead")
+	for _, d := range watched {
+		w.poll(d.Directory, d.Tree, w.done)
+	}
+	w.mutex.Unlock()
+	w.Reindexer.RescanAll()
+}
+
+// poll lists a directory now and then every PollInterval in the background,
+// reporting what has changed since the last listing, until done is closed.
+// Must be called with the mutex held.
+func (w *Watcher) poll(directory string, tree bool, done chan struct{}) {
+	logger.Info("Polling directory", "directory", directory, "interval", w.PollInterval)
+	storage := w.BoxHandler.StorageFor(directory)
+	previous, err := listObjects(storage, tree)
+	if err != nil {
+		logger.Warn("Could not list directory", "directory", directory, "error", err)
+	}
+	go w.follow(directory, tree, storage, previous, done)
+}
+
+func (w *Watcher) follow(directory string, tree bool, storage Storage, previous map[string]StorageObject, done chan struct{}) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		current, err := listObjects(storage, tree)
+		if err != nil {
+			logger.Warn("Could not list directory, will try again", "directory", directory, "error", err)
+			continue
+		}
+		if previous == nil {
+			previous = current
+			w.Reindexer.RescanAll()
+			continue
+		}
+		w.compare(storage, previous, current)
+		previous = current
+	}
+}
+
+// compare reports the differences between two listings of a storage.
+func (w *Watcher) compare(storage Storage, previous map[string]StorageObject, current map[string]StorageObject) {
+	_, local := storage.(*FileStorage)
+	changed := false
+	for key, object := range current {
+		if old, ok := previous[key]; !ok || old.Size != object.Size || !old.ModTime.Equal(object.ModTime) {
+			changed = true
+			if local {
+				w.Reindexer.Changed(storage.Location(key), true)
+			}
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changed = true
+			if local {
+				w.Reindexer.Changed(storage.Location(key), false)
+			}
+		}
+	}
+	// Remote storages are not indexed file by file.
+	if changed && !local {
+		w.Reindexer.RescanAll()
+	}
+}
+
+func listObjects(s Storage, recursive bool) (map[string]StorageObject, error) {
+	objects, err := s.List(recursive)
+	if err != nil {
+		return nil, err
+	}
+	listing := make(map[string]StorageObject)
+	for _, o := range objects {
+		listing[o.Key] = o
+	}
+	return listing, nil
+}
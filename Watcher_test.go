@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestPolledDirectoriesAreReindexed(t *testing.T) {
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	ri := &Reindexer{BoxHandler: bh, Window: 10 * time.Millisecond}
+	w := &Watcher{BoxHandler: bh, Reindexer: ri, PollInterval: 20 * time.Millisecond}
+	defer w.Close()
+	w.Watch(dir, true)
+
+	ioutil.WriteFile(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"), []byte("two"), 0644)
+	waitFor(t, func() bool { return bh.GetBox("benphegan", "dev").CurrentVersion.Version == "2.0" })
+
+	os.Remove(filepath.Join(dir, "benphegan-VAGRANTSLASH-dev__2.0__virtualbox.box"))
+	waitFor(t, func() bool { return bh.GetBox("benphegan", "dev").CurrentVersion.Version == "1.0" })
+}
+
+func TestUnwatchableDirectoriesArePolled(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "mounted")
+	port, host := bh.Port, bh.Hostname
+	ri := &Reindexer{BoxHandler: bh, Window: 10 * time.Millisecond, Rescan: func() {
+		bh.PopulateBoxes([]string{dir, missing}, &port, &host)
+	}}
+	w := &Watcher{BoxHandler: bh, Reindexer: ri, PollInterval: 20 * time.Millisecond}
+	defer w.Close()
+	w.Watch(missing, false)
+	assert.Empty(w.watched)
+
+	os.Mkdir(missing, 0755)
+	ioutil.WriteFile(filepath.Join(missing, "benphegan-VAGRANTSLASH-mounted__1.0__virtualbox.box"), []byte("one"), 0644)
+	waitFor(t, func() bool { return bh.BoxAvailable("benphegan", "mounted") })
+}
+
+func TestNewTreeDirectoriesAreWatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vagrantshadow-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := "localhost"
+	port := 8099
+	bh := &BoxHandler{Hostname: host, Port: port, TreeDirectories: []string{dir}}
+	bh.PopulateBoxes([]string{dir}, &port, &host)
+	ri := &Reindexer{BoxHandler: bh, Window: 10 * time.Millisecond, Rescan: func() {
+		bh.PopulateBoxes([]string{dir}, &port, &host)
+	}}
+	w := &Watcher{BoxHandler: bh, Reindexer: ri, PollInterval: time.Hour}
+	defer w.Close()
+	w.Watch(dir, false)
+
+	version := filepath.Join(dir, "benphegan", "dev", "1.0")
+	os.MkdirAll(version, 0755)
+	ioutil.WriteFile(filepath.Join(version, "virtualbox.box"), []byte("one"), 0644)
+	waitFor(t, func() bool { return bh.BoxAvailable("benphegan", "dev") })
+
+	os.MkdirAll(filepath.Join(dir, "benphegan", "dev", "2.0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "benphegan", "dev", "2.0", "virtualbox.box"), []byte("two"), 0644)
+	waitFor(t, func() bool { return bh.GetBox("benphegan", "dev").CurrentVersion.Version == "2.0" })
+}
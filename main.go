@@ -1,17 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"expvar"
 	"flag"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/go-fsnotify/fsnotify"
 	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
 )
 
@@ -23,8 +26,9 @@ var boxChecksTotal = expvar.NewInt("box_checks_total")
 var homepageVisits = expvar.NewInt("homepage_visits")
 var boxDownloads = expvar.NewMap("box_downloads")
 var requestUrlStats = expvar.NewMap("request_urls")
+var rejectedHosts = expvar.NewInt("rejected_hosts")
 
-func getBox(bh *BoxHandler, defaultHostName string, useRequestHost bool) http.Handler {
+func getBox(bh *BoxHandler, defaultHostName string) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		user := vars["user"]
@@ -32,25 +36,47 @@ func getBox(bh *BoxHandler, defaultHostName string, useRequestHost bool) http.Ha
 
 		boxQueries.Add(strings.Join([]string{user, "/", boxName}, ""), 1)
 		boxQueriesTotal.Add(1)
-		log.Println("Queried for " + user + "/" + boxName)
+		logger.Debug("Queried for box", "box", user+"/"+boxName)
 
 		box := bh.GetBox(user, boxName)
-
-		if useRequestHost {
-			log.Println("Using request Host to override download location:")
-			requestUrlStats.Add(r.Host, 1)
-			for i, version := range box.Versions {
-				for j, provider := range version.Providers {
-					log.Println("   Default: " + provider.DownloadUrl)
-					box.Versions[i].Providers[j].DownloadUrl = "http://" + r.Host + "/" + box.Name + "/" + version.Version + "/" + provider.Name + "/" + provider.Name + ".box"
-					box.Versions[i].Providers[j].Url = box.Versions[i].Providers[j].DownloadUrl
-					log.Println("   Updated: " + box.Versions[i].Providers[j].DownloadUrl)
+		catalogued := box.Username != ""
+		if bh.Upstream != nil && (box.Username == "" || bh.Upstream.Owns(box)) {
+			upstreamBox, err := bh.Upstream.Box(user, boxName)
+			if err == nil {
+				box = upstreamBox
+			} else if err != ErrUpstreamNotFound {
+				logger.Warn("Could not fetch box from upstream", "box", user+"/"+boxName, "error", err)
+				if box.Username == "" {
+					writeJsonError(w, http.StatusBadGateway, "Upstream unavailable")
+					return
 				}
 			}
+		}
+		if box.Username == "" {
+			notFound(w, r)
+			return
+		}
+		if !authorizeBox(bh, w, r, box) {
+			return
+		}
+		// Boxes only known upstream are left out so that made up names do not
+		// grow the number of series.
+		if catalogued {
+			metrics.Queried(user, boxName)
+		}
+		box = box.ServedVersions(hasAccess(bh, r, user))
 
+		base, ok := bh.responseBaseUrl(w, r)
+		if !ok {
+			return
+		}
+		if bh.RequestHost {
+			requestUrlStats.Add(strings.SplitN(base, "/", 4)[2], 1)
+			logger.Debug("Using request Host to override download location", "from", bh.BaseUrl(), "to", base)
 		} else {
 			requestUrlStats.Add(defaultHostName, 1)
 		}
+		box = rebasedBox(box, bh.BaseUrl(), base)
 
 		jsonResponse, _ := json.Marshal(box)
 
@@ -66,11 +92,50 @@ func downloadBox(bh *BoxHandler) http.Handler {
 		user := vars["user"]
 		boxName := vars["boxname"]
 		provider := vars["provider"]
+		architecture := vars["architecture"]
 		version := vars["version"]
-		log.Println("Downloading " + user + "/" + boxName + "/" + version + "/" + provider)
+		catalogBox := bh.GetBox(user, boxName)
+		if !authorizeBox(bh, w, r, catalogBox) {
+			return
+		}
+		if _, ok := bh.GetBoxFile(user, boxName, provider, architecture, version); !ok && bh.Upstream != nil && (catalogBox.Username == "" || bh.Upstream.Owns(catalogBox)) {
+			logger.Debug("Downloading from upstream", "box", user+"/"+boxName, "version", version, "provider", provider)
+			bh.Upstream.Download(w, r, user, boxName, version, provider, architecture)
+			return
+		}
+		if !catalogBox.Serves(version, hasAccess(bh, r, user)) {
+			notFound(w, r)
+			return
+		}
+		logger.Debug("Downloading", "box", user+"/"+boxName, "version", version, "provider", provider)
+		box, ok := bh.GetBoxFile(user, boxName, provider, architecture, version)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		bh.Upstream.UsedFile(box.LocalBoxFile)
+		object, err := box.Storage.Stat(box.Object.Key)
+		if err == ErrStorageObjectNotFound {
+			logger.Warn("Could not find box file", "file", box.LocalBoxFile, "error", err)
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Error("Could not read box file", "file", box.LocalBoxFile, "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "Could not read box file")
+			return
+		}
+		reader := newStorageReader(box.Storage, object.Key, object.Size)
+		defer reader.Close()
+		rr := &responseRecorder{ResponseWriter: w}
+		http.ServeContent(rr, r, path.Base(object.Key), object.ModTime, reader)
 		boxDownloads.Add(strings.Join([]string{user, "/", boxName, "/", provider, "/", version}, ""), 1)
 		boxDownloadsTotal.Add(1)
-		http.ServeFile(w, r, bh.GetBoxFileLocation(user, boxName, provider, version))
+		metrics.Downloaded(user, boxName, version, provider, box.Architecture, rr.Written)
+		// Resumed downloads are not counted again.
+		if rangeHeader := r.Header.Get("Range"); rr.Status < 300 && (rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")) {
+			bh.Stats.Record(user, boxName, version)
+		}
 	}
 	return http.HandlerFunc(fn)
 }
@@ -80,14 +145,18 @@ func checkBox(bh *BoxHandler) http.Handler {
 		vars := mux.Vars(r)
 		user := vars["user"]
 		boxName := vars["boxname"]
-		log.Println("Checking " + user + "/" + boxName)
+		logger.Debug("Checking box", "box", user+"/"+boxName)
 		boxChecks.Add(strings.Join([]string{user, "/", boxName}, ""), 1)
 		boxChecksTotal.Add(1)
+		if !authorizeBox(bh, w, r, bh.GetBox(user, boxName)) {
+			return
+		}
 		if bh.BoxAvailable(user, boxName) {
+			metrics.Checked(user, boxName)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 		} else {
-			w.WriteHeader(http.StatusNotFound)
+			notFound(w, r)
 		}
 	}
 	return http.HandlerFunc(fn)
@@ -96,59 +165,119 @@ func checkBox(bh *BoxHandler) http.Handler {
 func showHomepage(ht *HomePageTemplate) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		homepageVisits.Add(1)
+		metrics.Visited()
 
 		t, err := template.New("homepage").Parse(ht.TemplateString)
 		if err != nil {
-			log.Println("Could not parse provided template: " + err.Error())
+			logger.Error("Could not parse provided template", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = t.Execute(w, ht.BoxHandler)
+		base, ok := ht.BoxHandler.responseBaseUrl(w, r)
+		if !ok {
+			return
+		}
+		err = t.Execute(w, homepageData{BoxHandler: ht.BoxHandler, BaseUrl: base})
 		if err != nil {
-			log.Println("Failed to execute homepage template: " + err.Error())
+			logger.Error("Failed to execute homepage template", "error", err)
 		}
 	}
 	return http.HandlerFunc(fn)
 }
 
+// writeJson sends v as a JSON response with the given status code.
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	jsonResponse, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// writeJsonError sends an error body in the shape Vagrant Cloud uses.
+func writeJsonError(w http.ResponseWriter, status int, messages ...string) {
+	writeJson(w, status, map[string]interface{}{"errors": messages, "success": false})
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
-	log.Println("404 :", r.URL.Path, " ", r.Method)
-	w.WriteHeader(http.StatusNotFound)
+	logger.Debug("Not found", "path", r.URL.Path, "method", r.Method)
+	writeJsonError(w, http.StatusNotFound, "Resource not found!")
 }
 
-func setUpFileWatcher(directories []string, action func()) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal("Could not create file watcher, updates to file system will not be picked up.")
-	}
+func containsDirectory(directories []string, directory string) bool {
 	for _, d := range directories {
-		log.Println("Setting directory watch on : " + d)
-		watcher.Add(d)
-	}
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Events:
-				dirname := filepath.Dir(ev.Name)
-				log.Println("Directory change detected: " + dirname)
-				action()
-			case err := <-watcher.Errors:
-				log.Fatalln("error:", err)
-			}
+		if absoluteDirectory(d) == absoluteDirectory(directory) {
+			return true
 		}
-	}()
+	}
+	return false
 }
 
 func main() {
 
-	directory := flag.String("d", "./", "Semicolon separated list of directories containing .box files")
+	directory := flag.String("d", "./", "Semicolon separated list of directories (or s3://bucket/prefix locations) containing .box files")
 	port := flag.Int("p", 8099, "Port to listen on.")
 	hostname := flag.String("h", "localhost", "Hostname for static box content.")
 	templateFile := flag.String("t", "", "Template file for the vagrantshadow homepage, if you dont like the default!")
 	writeOutTemplate := flag.Bool("w", false, "Write a template page to disk so you can modify")
 	useRequestHost := flag.Bool("r", false, "Use the request Host value to specify download location of box files, overrides \"hostname\" setting")
+	cacheFile := flag.String("c", "", "File used to cache box checksums, defaults to .vagrantshadow-cache.json in the publish directory")
+	treeDirectory := flag.String("l", "", "Semicolon separated list of directories containing boxes laid out as user/box/version/provider.box")
+	boxRegex := flag.String("x", "", "Regular expression box filenames must match, with owner, boxname, version, provider and optional architecture named groups")
+	s3Endpoint := flag.String("s3-endpoint", "https://s3.amazonaws.com", "Endpoint for s3://bucket/prefix directories, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	s3Region := flag.String("s3-region", "us-east-1", "Region for s3://bucket/prefix directories")
+	publishDirectory := flag.String("u", "", "Directory boxes published through the API are written to, defaults to the first directory in -d")
+	tokenFile := flag.String("k", ".vagrantshadow-tokens.json", "Token store used to authenticate access to private boxes and publishing, managed with the token command")
+	debounce := flag.Duration("debounce", 2*time.Second, "How long the box directories must be quiet before changes are indexed")
+	pollDirectories := flag.String("poll", "", "Semicolon separated list of directories to poll for changes rather than watch, such as NFS or SMB mounts, or \"all\"")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second, "How often polled directories, including s3:// locations, are listed")
+	statsFile := flag.String("stats", "", "File download counts are kept in, defaults to .vagrantshadow-stats.json in the publish directory")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve HTTPS with, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	redirectPort := flag.Int("redirect-http", 0, "Port to redirect plain HTTP requests to HTTPS from, when serving HTTPS")
+	externalUrl := flag.String("base-url", "", "External URL vagrantshadow is reached on, such as https://example.com/vagrant, used for generated URLs and as a route prefix")
+	trustedProxies := flag.String("trusted-proxies", "", "Semicolon separated list of proxy addresses or CIDR ranges whose X-Forwarded-* and Forwarded headers are believed")
+	allowedHosts := flag.String("allowed-hosts", "", "Semicolon separated list of hostnames, or patterns such as *.example.com, that -r may build URLs for, defaults to -h; \"*\" allows any")
+	rejectUnknownHosts := flag.Bool("reject-unknown-hosts", false, "With -r, reject requests for hosts not in -allowed-hosts rather than answering with -h")
+	upstreamUrl := flag.String("upstream", "", "Vagrant Cloud compatible server, such as https://vagrantcloud.com, to fetch boxes that are not found locally from")
+	upstreamCache := flag.String("upstream-cache", ".vagrantshadow-upstream", "Directory boxes fetched from -upstream are cached in")
+	upstreamCacheSize := flag.Int64("upstream-cache-size", 51200, "Largest size in megabytes of the -upstream cache, the least recently used boxes are removed beyond it")
+	syncFrom := flag.String("sync-from", "", "URL of another vagrantshadow to copy boxes from into the publish directory every -sync-interval, using the token in VAGRANT_CLOUD_TOKEN")
+	syncBoxes := flag.String("sync-boxes", "", "Semicolon separated list of user/box patterns, such as acme/*, to copy with -sync-from, defaults to every box")
+	syncConstraint := flag.String("sync-constraint", "", "Version constraint, such as \">= 1.0, < 2.0\", versions copied with -sync-from must meet")
+	syncInterval := flag.Duration("sync-interval", time.Hour, "How often boxes are copied with -sync-from")
+	keepVersions := flag.Int("keep-versions", 0, "Retention: keep the newest N versions of each box when pruning, 0 for no limit")
+	keepDownloadedDays := flag.Int("keep-downloaded-days", 0, "Retention: keep versions downloaded in the last N days when pruning, 0 for no limit")
+	trashDirectory := flag.String("trash", "", "Directory pruned box files are moved to, they are deleted if not set")
+	pruneInterval := flag.Duration("prune-interval", 0, "How often the server prunes old versions under the retention rules, 0 to only prune with the prune command")
+	openPublish := flag.Bool("open-publish", false, "Let anyone use the publishing API while the token store is empty, rather than refusing it until a token is added")
+	privateBoxes := flag.String("private", "", "Semicolon separated list of user/box patterns, such as benphegan/*, that need a token to be seen or downloaded")
+	logLevel := flag.String("log-level", "info", "Lowest level of message logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Format of log messages: text, logfmt or json")
+	accessLogFile := flag.String("access-log", "", "File every request is logged to, or - for standard output, no access log is written if not set")
+	accessLogFormat := flag.String("access-log-format", "combined", "Format of the access log: combined, for the Combined Log Format followed by the time taken in seconds, or json")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100, "Size in megabytes the access log is rotated at, 0 to leave rotation to logrotate, which should send SIGHUP")
+	accessLogBackups := flag.Int("access-log-backups", 5, "Number of rotated access logs kept")
 	flag.Parse()
 
+	level, err := parseLevel(*logLevel)
+	if err != nil {
+		logger.Fatal("Invalid log level", "error", err)
+	}
+	if err := checkLogFormat(*logFormat); err != nil {
+		logger.Fatal("Invalid log format", "error", err)
+	}
+	if err := checkAccessLogFormat(*accessLogFormat); err != nil {
+		logger.Fatal("Invalid access log format", "error", err)
+	}
+	logger.Level = level
+	logger.Format = *logFormat
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{Logger: logger, Level: LevelWarn})
+
+	if flag.Arg(0) == "token" {
+		os.Exit(tokenCommand(*tokenFile, flag.Args()[1:]))
+	}
+
 	home := HomePageTemplate{}
 	if *writeOutTemplate {
 		//output a template homepage so people have something to play
@@ -156,7 +285,7 @@ func main() {
 	}
 
 	if *useRequestHost {
-		log.Println("Using request host value for download URLs")
+		logger.Info("Using request host value for download URLs")
 	}
 
 	directories := strings.Split(*directory, ";")
@@ -166,28 +295,225 @@ func main() {
 		directories = append(directories, ".")
 	}
 
-	log.Println("Responding on host: ", *hostname)
-	log.Println("Serving files from: ", *directory)
-	bh := BoxHandler{}
-	log.Println("Using box regex:" + bh.BoxRegex())
+	treeDirectories := []string{}
+	if *treeDirectory != "" {
+		treeDirectories = strings.Split(*treeDirectory, ";")
+	}
+
+	if *publishDirectory == "" {
+		*publishDirectory = directories[0]
+	} else if !containsDirectory(directories, *publishDirectory) && !containsDirectory(treeDirectories, *publishDirectory) {
+		directories = append(directories, *publishDirectory)
+	}
+	if *upstreamUrl != "" {
+		if isRemoteDirectory(*upstreamCache) {
+			logger.Fatal("The upstream cache must be a local directory")
+		}
+		if err := os.MkdirAll(*upstreamCache, 0755); err != nil {
+			logger.Fatal("Could not create upstream cache", "error", err)
+		}
+		if !containsDirectory(directories, *upstreamCache) && !containsDirectory(treeDirectories, *upstreamCache) {
+			directories = append(directories, *upstreamCache)
+		}
+	}
+	flatDirectories := directories
+	directories = append(append([]string{}, flatDirectories...), treeDirectories...)
+
+	logger.Info("Responding on host", "host", *hostname)
+	logger.Info("Serving files", "directories", *directory)
+	if len(treeDirectories) > 0 {
+		logger.Info("Serving user/box/version/provider.box trees", "directories", *treeDirectory)
+	}
+	bh := BoxHandler{TreeDirectories: treeDirectories, FilenamePattern: *boxRegex}
+	bh.S3 = S3Config{
+		Endpoint:     *s3Endpoint,
+		Region:       *s3Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	tokens := TokenStore{Location: *tokenFile}
+	if err := tokens.Load(); err != nil {
+		logger.Fatal("Could not read token store", "error", err)
+	}
+	bh.Tokens = &tokens
+	bh.OpenPublish = *openPublish
+	if *privateBoxes != "" {
+		bh.PrivateBoxes = strings.Split(*privateBoxes, ";")
+	}
+	if err := bh.CheckBoxRegex(); err != nil {
+		logger.Fatal("Invalid box regex", "error", err)
+	}
+	logger.Info("Using box regex", "regex", bh.BoxRegex())
 	bh.Hostname = *hostname
 	bh.Port = *port
+	if *tlsCert != "" {
+		bh.Scheme = "https"
+	}
+	if *externalUrl != "" {
+		external, err := parseExternalUrl(*externalUrl)
+		if err != nil {
+			logger.Fatal("Invalid base URL", "error", err)
+		}
+		bh.ExternalUrl = external
+	}
+	proxies, err := parseTrustedProxies(strings.Split(*trustedProxies, ";"))
+	if err != nil {
+		logger.Fatal("Invalid trusted proxy", "error", err)
+	}
+	bh.TrustedProxies = proxies
+	if *allowedHosts != "" {
+		bh.AllowedHosts = strings.Split(*allowedHosts, ";")
+	}
+	bh.RejectUnknownHosts = *rejectUnknownHosts
+	bh.RequestHost = *useRequestHost
+	publisher := Publisher{BoxHandler: &bh, Directory: *publishDirectory, Refresh: func() { bh.PopulateBoxes(directories, port, hostname) }}
+	publisher.Load()
+	bh.Publisher = &publisher
+	if flag.Arg(0) == "version" {
+		bh.PopulateBoxes(directories, port, hostname)
+		os.Exit(versionCommand(&publisher, flag.Args()[1:]))
+	}
+	syncer := Sync{Token: os.Getenv("VAGRANT_CLOUD_TOKEN"), Directory: *publishDirectory, BoxHandler: &bh}
+	if flag.Arg(0) == "sync" {
+		bh.PopulateBoxes(directories, port, hostname)
+		os.Exit(syncCommand(&syncer, flag.Args()[1:]))
+	}
+	if *cacheFile == "" {
+		*cacheFile = ".vagrantshadow-cache.json"
+		if !isRemoteDirectory(*publishDirectory) {
+			*cacheFile = filepath.Join(*publishDirectory, *cacheFile)
+		}
+	}
+	if *statsFile == "" {
+		*statsFile = ".vagrantshadow-stats.json"
+		if !isRemoteDirectory(*publishDirectory) {
+			*statsFile = filepath.Join(*publishDirectory, *statsFile)
+		}
+	}
+	if flag.Arg(0) == "stats" {
+		os.Exit(statsCommand(*statsFile, flag.Args()[1:]))
+	}
+	stats := DownloadStats{Location: *statsFile, SaveInterval: 10 * time.Second, OnUpdate: bh.applyDownloadStats}
+	if err := stats.Load(); err != nil {
+		logger.Fatal("Could not read download statistics", "error", err)
+	}
+	bh.Stats = &stats
+	if isRemoteDirectory(*trashDirectory) {
+		logger.Fatal("The trash must be a local directory")
+	}
+	pruner := Pruner{
+		BoxHandler: &bh,
+		Policy:     RetentionPolicy{KeepVersions: *keepVersions, KeepDownloadedDays: *keepDownloadedDays},
+		Trash:      *trashDirectory,
+		Refresh:    func() { bh.PopulateBoxes(directories, port, hostname) },
+	}
+	if flag.Arg(0) == "prune" {
+		bh.PopulateBoxes(directories, port, hostname)
+		os.Exit(pruneCommand(&pruner, flag.Args()[1:]))
+	}
+	cache := BoxCache{Location: *cacheFile, OnUpdate: bh.applyBoxCache}
+	cache.Load()
+	bh.Cache = &cache
+	logger.Info("Publishing boxes", "directory", *publishDirectory)
+	if *upstreamUrl != "" {
+		logger.Info("Fetching boxes not found locally", "upstream", *upstreamUrl)
+		upstream := Upstream{
+			Url:         *upstreamUrl,
+			Directory:   *upstreamCache,
+			MaxSize:     *upstreamCacheSize << 20,
+			BoxHandler:  &bh,
+			Refresh:     func() { bh.PopulateBoxes(directories, port, hostname) },
+			MetadataTTL: 5 * time.Minute,
+		}
+		upstream.Evict("")
+		bh.Upstream = &upstream
+	}
 	bh.PopulateBoxes(directories, port, hostname)
 	home.BoxHandler = &bh
 	home.TemplateString = home.GetTemplateString(*templateFile)
 
-	setUpFileWatcher(directories, func() { bh.PopulateBoxes(directories, port, hostname) })
+	reindexer := Reindexer{BoxHandler: &bh, Window: *debounce, Rescan: func() { bh.PopulateBoxes(directories, port, hostname) }}
+	watcher := Watcher{BoxHandler: &bh, Reindexer: &reindexer, PollInterval: *pollInterval}
+	for _, d := range directories {
+		watcher.Watch(d, *pollDirectories == "all" || containsDirectory(strings.Split(*pollDirectories, ";"), d))
+	}
+	if *syncFrom != "" {
+		syncer.Source = *syncFrom
+		syncer.Constraint = *syncConstraint
+		if *syncBoxes != "" {
+			syncer.Boxes = strings.Split(*syncBoxes, ";")
+		}
+		logger.Info("Syncing boxes", "source", *syncFrom, "interval", *syncInterval)
+		go syncer.Schedule(*syncInterval)
+	}
+	if *pruneInterval > 0 {
+		logger.Info("Pruning old versions", "interval", *pruneInterval)
+		go pruner.Schedule(*pruneInterval)
+	}
 
 	m := mux.NewRouter()
-	m.Handle("/{user}/{boxname}", getBox(&bh, *hostname, *useRequestHost)).Methods("GET")
-	m.Handle("/{user}/{boxname}", checkBox(&bh)).Methods("HEAD")
-	m.Handle("/", showHomepage(&home)).Methods("GET")
+	//Vagrant Cloud publishing API, as used by Packer and `vagrant cloud publish`
+	m.Handle("/api/v1/boxes", requireToken(&bh, createBoxHandler(&publisher))).Methods("POST").Name("api_create_box")
+	m.Handle("/api/v1/search", searchHandler(&bh)).Methods("GET").Name("api_search")
+	m.Handle("/api/v1/box/{user}/{boxname}", showBoxHandler(&publisher)).Methods("GET").Name("api_show_box")
+	m.Handle("/api/v1/box/{user}/{boxname}", requireToken(&bh, updateBoxHandler(&publisher))).Methods("PUT").Name("api_update_box")
+	m.Handle("/api/v1/box/{user}/{boxname}/versions", requireToken(&bh, createVersionHandler(&publisher))).Methods("POST").Name("api_create_version")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/providers", requireToken(&bh, createProviderHandler(&publisher))).Methods("POST").Name("api_create_provider")
+	m.Handle("/api/v1/user/{user}", showUserHandler(&publisher)).Methods("GET").Name("api_show_user")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}", showVersionHandler(&publisher)).Methods("GET").Name("api_show_version")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}", showProviderHandler(&publisher)).Methods("GET").Name("api_show_provider")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/upload", requireToken(&bh, uploadUrlHandler(&publisher, false))).Methods("GET").Name("api_upload_url")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/upload/direct", requireToken(&bh, uploadUrlHandler(&publisher, true))).Methods("GET").Name("api_upload_url_direct")
+	// Registered after the routes above, so that "upload" is not taken for an
+	// architecture.
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/{architecture}", showProviderHandler(&publisher)).Methods("GET").Name("api_show_provider_architecture")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/{architecture}/upload", requireToken(&bh, uploadUrlHandler(&publisher, false))).Methods("GET").Name("api_upload_url_architecture")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/provider/{provider}/{architecture}/upload/direct", requireToken(&bh, uploadUrlHandler(&publisher, true))).Methods("GET").Name("api_upload_url_direct_architecture")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/release", requireToken(&bh, versionStatusHandler(&publisher, VersionActive))).Methods("PUT").Name("api_release_version")
+	m.Handle("/api/v1/box/{user}/{boxname}/version/{version}/revoke", requireToken(&bh, versionStatusHandler(&publisher, VersionRevoked))).Methods("PUT").Name("api_revoke_version")
+	m.Handle("/api/v1/upload/{token}", uploadHandler(&publisher)).Methods("PUT").Name("api_upload")
+	m.Handle("/api/v1/upload/{token}/complete", uploadCompleteHandler(&publisher)).Methods("PUT").Name("api_upload_complete")
+	m.Handle("/{user}/{boxname}", getBox(&bh, *hostname)).Methods("GET").Name("box")
+	m.Handle("/{user}/{boxname}", checkBox(&bh)).Methods("HEAD").Name("box_check")
+	m.Handle("/metrics", metricsHandler(&bh)).Methods("GET").Name("metrics")
+	m.Handle("/", showHomepage(&home)).Methods("GET").Name("homepage")
 	//Handling downloads that look like Vagrant Cloud
 	//https://vagrantcloud.com/benphegan/boot2docker/version/2/provider/vmware_desktop.box
-	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(&bh)).Methods("GET")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(&bh)).Methods("GET").Name("download")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{architecture}/{boxfile}", downloadBox(&bh)).Methods("GET").Name("download_architecture")
 	m.NotFoundHandler = http.HandlerFunc(notFound)
-	http.Handle("/", m)
+	http.Handle("/", instrumentRoutes(m))
+	handler := stripPathPrefix(bh.PathPrefix(), http.DefaultServeMux)
+	if *accessLogFile != "" {
+		accessLog := AccessLog{Output: os.Stdout, Format: *accessLogFormat, BoxHandler: &bh}
+		if *accessLogFile != "-" {
+			file := RotatingFile{Path: *accessLogFile, MaxSize: *accessLogMaxSize << 20, Backups: *accessLogBackups}
+			if err := file.Reopen(); err != nil {
+				logger.Fatal("Could not open access log", "file", *accessLogFile, "error", err)
+			}
+			reopenOnHangup(&file)
+			accessLog.Output = &file
+		}
+		logger.Info("Writing access log", "file", *accessLogFile, "format", *accessLogFormat)
+		handler = logRequests(&accessLog, handler)
+	}
 
-	log.Println("Listening on port: ", *port)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+	if *tlsCert != "" {
+		certificates := CertificateLoader{CertFile: *tlsCert, KeyFile: *tlsKey}
+		if err := certificates.Load(); err != nil {
+			logger.Fatal("Could not load certificate", "error", err)
+		}
+		if *redirectPort != 0 {
+			logger.Info("Redirecting HTTP to HTTPS", "port", *redirectPort)
+			go func() {
+				logger.Fatal("Could not redirect HTTP", "error", http.ListenAndServe(":"+strconv.Itoa(*redirectPort), redirectToHttps(*port)))
+			}()
+		}
+		server := http.Server{Addr: ":" + strconv.Itoa(*port), Handler: handler, TLSConfig: &tls.Config{GetCertificate: certificates.GetCertificate}}
+		logger.Info("Listening for HTTPS", "port", *port)
+		logger.Fatal("Could not serve HTTPS", "error", server.ListenAndServeTLS("", ""))
+	}
+	logger.Info("Listening", "port", *port)
+	logger.Fatal("Could not serve HTTP", "error", http.ListenAndServe(":"+strconv.Itoa(*port), handler))
 }
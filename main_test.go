@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenPhegan/vagrantshadow/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestMissingBoxesAreNotFound(t *testing.T) {
+	assert := assert.New(t)
+	bh, dir := newIndexedDirectory(t)
+	defer os.RemoveAll(dir)
+	m := mux.NewRouter()
+	m.Handle("/{user}/{boxname}", getBox(bh, bh.Hostname)).Methods("GET")
+	m.Handle("/{user}/{boxname}", checkBox(bh)).Methods("HEAD")
+	m.Handle("/{user}/{boxname}/{version}/{provider}/{boxfile}", downloadBox(bh)).Methods("GET")
+	m.NotFoundHandler = http.HandlerFunc(notFound)
+	downloads := boxDownloadsTotal.Value()
+
+	for _, url := range []string{
+		"/nobody/dev",
+		"/benphegan/missing",
+		"/nobody/dev/1.0/virtualbox/virtualbox.box",
+		"/benphegan/missing/1.0/virtualbox/virtualbox.box",
+		"/benphegan/dev/9.9/virtualbox/virtualbox.box",
+		"/benphegan/dev/1.0/vmware/vmware.box",
+		"/no/such/route/at/all",
+	} {
+		w := doRequest(m, "GET", url, "")
+		assert.Equal(http.StatusNotFound, w.Code, url)
+		var body map[string]interface{}
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &body), url)
+		assert.Equal(false, body["success"], url)
+		assert.Equal([]interface{}{"Resource not found!"}, body["errors"], url)
+	}
+	assert.Equal(http.StatusNotFound, doRequest(m, "HEAD", "/benphegan/missing", "").Code)
+	assert.Equal(downloads, boxDownloadsTotal.Value())
+
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/benphegan/dev", "").Code)
+	assert.Equal(http.StatusOK, doRequest(m, "HEAD", "/benphegan/dev", "").Code)
+	assert.Equal(http.StatusOK, doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "").Code)
+
+	os.Remove(bh.GetBox("benphegan", "dev").CurrentVersion.Providers[0].LocalBoxFile)
+	assert.Equal(http.StatusNotFound, doRequest(m, "GET", "/benphegan/dev/1.0/virtualbox/virtualbox.box", "").Code)
+	assert.Equal(downloads+1, boxDownloadsTotal.Value())
+}
+
+func TestPublishingApiErrorsAreJson(t *testing.T) {
+	assert := assert.New(t)
+	_, m, dir := newTestPublisher(t)
+	defer os.RemoveAll(dir)
+	doRequest(m, "POST", "/api/v1/boxes", `{"box": {"username": "benphegan", "name": "dev"}}`)
+
+	for _, url := range []string{
+		"/api/v1/box/nobody/dev",
+		"/api/v1/box/benphegan/missing",
+		"/api/v1/box/benphegan/dev/version/9.9/provider/virtualbox",
+		"/api/v1/box/benphegan/dev/version/9.9/provider/virtualbox/upload",
+	} {
+		w := doRequest(m, "GET", url, "")
+		assert.Equal(http.StatusNotFound, w.Code, url)
+		var body map[string]interface{}
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &body), url)
+		assert.Equal(false, body["success"], url)
+	}
+}